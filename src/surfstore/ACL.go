@@ -0,0 +1,158 @@
+package surfstore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+type Access int
+
+const (
+	AccessNone Access = iota
+	AccessRead
+	AccessReadWrite
+)
+
+func (a Access) String() string {
+	switch a {
+	case AccessRead:
+		return "r"
+	case AccessReadWrite:
+		return "rw"
+	default:
+		return "none"
+	}
+}
+
+func ParseAccess(s string) (Access, error) {
+	switch s {
+	case "r", "read":
+		return AccessRead, nil
+	case "rw", "read-write":
+		return AccessReadWrite, nil
+	default:
+		return AccessNone, errors.New("invalid access, must be r or rw")
+	}
+}
+
+// An ACLEntry grants a collaborator access to a shared folder of a namespace.
+// Folder is a path prefix without trailing slash, e.g. "docs/team".
+type ACLEntry struct {
+	Folder string
+	User   string
+	Access Access
+}
+
+func normalizeFolder(folder string) string {
+	return strings.Trim(folder, "/")
+}
+
+// isInFolder reports whether the file is the folder itself or lies below it.
+func isInFolder(filename string, folder string) bool {
+	return folder == "" || filename == folder || strings.HasPrefix(filename, folder+"/")
+}
+
+// getAccessFromACL returns the access granted by the entry of the innermost
+// shared folder containing the file.
+func getAccessFromACL(entries []ACLEntry, filename string) Access {
+	access := AccessNone
+	matchedFolderLen := -1
+	for _, entry := range entries {
+		if isInFolder(filename, entry.Folder) && len(entry.Folder) > matchedFolderLen {
+			access = entry.Access
+			matchedFolderLen = len(entry.Folder)
+		}
+	}
+	return access
+}
+
+// SetAccess grants the user access to the folder, replacing any previous
+// grant of the same folder.
+func (m *MetaStore) SetAccess(folder string, username string, access Access) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	entry := ACLEntry{Folder: normalizeFolder(folder), User: username, Access: access}
+	if m.journal != nil {
+		err := m.journal.Append(JournalRecord{Namespace: m.namespace, ACL: &entry})
+		if err != nil {
+			return err
+		}
+	}
+	m.applyACLEntry(entry)
+	return nil
+}
+
+func (m *MetaStore) RemoveAccess(folder string, username string) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	entry := ACLEntry{Folder: normalizeFolder(folder), User: username, Access: AccessNone}
+	if _, ok := m.ACL[entry.Folder][username]; !ok {
+		return false, nil
+	}
+	if m.journal != nil {
+		err := m.journal.Append(JournalRecord{Namespace: m.namespace, ACL: &entry})
+		if err != nil {
+			return false, err
+		}
+	}
+	m.applyACLEntry(entry)
+	return true, nil
+}
+
+// applyACLEntry sets the grant of the entry, AccessNone removes it. The
+// caller must hold the lock.
+func (m *MetaStore) applyACLEntry(entry ACLEntry) {
+	if entry.Access == AccessNone {
+		delete(m.ACL[entry.Folder], entry.User)
+		if len(m.ACL[entry.Folder]) == 0 {
+			delete(m.ACL, entry.Folder)
+		}
+		return
+	}
+	if _, ok := m.ACL[entry.Folder]; !ok {
+		m.ACL[entry.Folder] = make(map[string]Access)
+	}
+	m.ACL[entry.Folder][entry.User] = entry.Access
+}
+
+// GetACL returns the entries of the folders below the given folder, or of all
+// folders of the namespace when folder is empty.
+func (m *MetaStore) GetACL(folder string) []ACLEntry {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	folder = normalizeFolder(folder)
+	var entries []ACLEntry
+	for sharedFolder, users := range m.ACL {
+		if !isInFolder(sharedFolder, folder) {
+			continue
+		}
+		for username, access := range users {
+			entries = append(entries, ACLEntry{Folder: sharedFolder, User: username, Access: access})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Folder != entries[j].Folder {
+			return entries[i].Folder < entries[j].Folder
+		}
+		return entries[i].User < entries[j].User
+	})
+	return entries
+}
+
+// GetUserACL returns the entries granting access to the user.
+func (m *MetaStore) GetUserACL(username string) []ACLEntry {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var entries []ACLEntry
+	for folder, users := range m.ACL {
+		if access, ok := users[username]; ok {
+			entries = append(entries, ACLEntry{Folder: folder, User: username, Access: access})
+		}
+	}
+	return entries
+}
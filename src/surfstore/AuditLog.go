@@ -0,0 +1,150 @@
+package surfstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// An AuditEntry records the update of one file by UpdateFile or UpdateFiles,
+// whether the server accepted it or not.
+type AuditEntry struct {
+	Time time.Time
+	// User is empty when authentication is disabled
+	User      string `json:",omitempty"`
+	Client    string
+	Namespace string
+	Filename  string
+	// OldVersion is the version stored before the call, 0 for a new file
+	OldVersion int
+	NewVersion int
+	Tombstone  bool
+	Accepted   bool
+	// Reason tells why the update was rejected
+	Reason    string `json:",omitempty"`
+	RequestID string `json:",omitempty"`
+}
+
+// AuditLog is an append-only file of the metadata changes, one JSON encoded
+// AuditEntry per line. Unlike the journal it is never compacted.
+type AuditLog struct {
+	Path string
+
+	mtx    sync.Mutex
+	file   *os.File
+	closed bool
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{Path: path, file: file}, nil
+}
+
+// Append writes the entries and syncs them to disk before it returns.
+func (a *AuditLog) Append(entries ...AuditEntry) error {
+	var lines []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.closed {
+		return errors.New("audit log is closed")
+	}
+	_, err := a.file.Write(lines)
+	if err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *AuditLog) Close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	return a.file.Close()
+}
+
+// CheckHealth fails once the audit log is closed.
+func (a *AuditLog) CheckHealth() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if a.closed {
+		return errors.New("audit log is closed")
+	}
+	return nil
+}
+
+// AuditFilter selects audit entries, empty fields match every entry.
+type AuditFilter struct {
+	Filename  string
+	User      string
+	Namespace string
+	// Since and Until limit the time of the entries, Until is exclusive
+	Since time.Time
+	Until time.Time
+}
+
+func (f AuditFilter) Match(entry AuditEntry) bool {
+	return (f.Filename == "" || entry.Filename == f.Filename) &&
+		(f.User == "" || entry.User == f.User) &&
+		(f.Namespace == "" || entry.Namespace == f.Namespace) &&
+		(f.Since.IsZero() || !entry.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || entry.Time.Before(f.Until))
+}
+
+// QueryAuditLog calls fn with every entry of the audit log at path matching
+// the filter, in the order they were written. A truncated last line, left
+// behind by a crash during a write, is ignored.
+func QueryAuditLog(path string, filter AuditFilter, fn func(entry AuditEntry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var entry AuditEntry
+			if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+				return jsonErr
+			}
+			if filter.Match(entry) {
+				fn(entry)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// getClientHost returns the host of a remote address like "10.0.0.1:51234".
+func getClientHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,325 @@
+package surfstore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrUserNotFound    = errors.New("user not found")
+	ErrTokenNotFound   = errors.New("token not found")
+)
+
+// A Token is an API token issued to a user. Only the SHA-256 hash of the
+// token is stored, the token itself is shown once when it is created.
+type Token struct {
+	ID        string
+	Hash      string
+	CreatedAt time.Time
+}
+
+type User struct {
+	Name   string
+	Admin  bool
+	Quota  Quota
+	Tokens []Token
+}
+
+// AuthStore keeps the user accounts of the server in a JSON file. The file is
+// reloaded whenever it changes on disk, so tokens created or revoked by the
+// admin command take effect without restarting the server.
+type AuthStore struct {
+	Path string
+
+	mtx     sync.Mutex
+	users   map[string]*User
+	modTime time.Time
+}
+
+func NewAuthStore(path string) (*AuthStore, error) {
+	as := &AuthStore{Path: path, users: map[string]*User{}}
+	err := as.reload()
+	if err != nil {
+		return nil, err
+	}
+	return as, nil
+}
+
+// reload reads the user file again if it was modified since the last read.
+// A missing file is treated as an empty user list.
+func (as *AuthStore) reload() error {
+	fileInfo, err := os.Stat(as.Path)
+	if os.IsNotExist(err) {
+		as.users = map[string]*User{}
+		as.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fileInfo.ModTime().Equal(as.modTime) {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(as.Path)
+	if err != nil {
+		return err
+	}
+
+	var userList []*User
+	if len(content) > 0 {
+		err = json.Unmarshal(content, &userList)
+		if err != nil {
+			return err
+		}
+	}
+
+	users := make(map[string]*User)
+	for _, user := range userList {
+		users[user.Name] = user
+	}
+	as.users = users
+	as.modTime = fileInfo.ModTime()
+	return nil
+}
+
+func (as *AuthStore) save() error {
+	userList := make([]*User, 0, len(as.users))
+	for _, user := range as.users {
+		userList = append(userList, user)
+	}
+	sort.Slice(userList, func(i, j int) bool { return userList[i].Name < userList[j].Name })
+
+	content, err := json.MarshalIndent(userList, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so the server never reads a partial file
+	tmpFile, err := ioutil.TempFile(filepath.Dir(as.Path), ".users-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(append(content, '\n'))
+	if err == nil {
+		err = tmpFile.Chmod(0600)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile.Name(), as.Path)
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := os.Stat(as.Path)
+	if err == nil {
+		as.modTime = fileInfo.ModTime()
+	}
+	return err
+}
+
+// Authenticate returns the user owning the token. Tokens have the form
+// "<id>.<secret>", the id is used to find the token without scanning all
+// hashes.
+func (as *AuthStore) Authenticate(token string) (*User, error) {
+	as.mtx.Lock()
+	defer as.mtx.Unlock()
+
+	err := as.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	tokenParts := strings.SplitN(token, ".", 2)
+	if len(tokenParts) != 2 {
+		return nil, ErrUnauthenticated
+	}
+	tokenHash := getTokenHash(token)
+
+	for _, user := range as.users {
+		for _, userToken := range user.Tokens {
+			if userToken.ID != tokenParts[0] {
+				continue
+			}
+			if subtle.ConstantTimeCompare([]byte(userToken.Hash), []byte(tokenHash)) == 1 {
+				authUser := *user
+				return &authUser, nil
+			}
+			return nil, ErrUnauthenticated
+		}
+	}
+
+	return nil, ErrUnauthenticated
+}
+
+// LookupUser returns the user with the given name. It is used for clients
+// authenticated by their TLS certificate instead of a token.
+func (as *AuthStore) LookupUser(username string) (*User, error) {
+	as.mtx.Lock()
+	defer as.mtx.Unlock()
+
+	err := as.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	user, ok := as.users[username]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	authUser := *user
+	return &authUser, nil
+}
+
+// CreateToken issues a new token for the user, creating the user first if it
+// does not exist yet. The returned token is not stored anywhere.
+func (as *AuthStore) CreateToken(username string, admin bool) (string, error) {
+	as.mtx.Lock()
+	defer as.mtx.Unlock()
+
+	err := as.reload()
+	if err != nil {
+		return "", err
+	}
+
+	if username == "" || strings.ContainsAny(username, " ,/\n") {
+		return "", errors.New("invalid user name")
+	}
+
+	user, ok := as.users[username]
+	if !ok {
+		user = &User{Name: username}
+		as.users[username] = user
+	}
+	user.Admin = user.Admin || admin
+
+	tokenID, err := getRandomHex(4)
+	if err != nil {
+		return "", err
+	}
+	secret, err := getRandomHex(32)
+	if err != nil {
+		return "", err
+	}
+	token := tokenID + "." + secret
+
+	user.Tokens = append(user.Tokens, Token{
+		ID:        tokenID,
+		Hash:      getTokenHash(token),
+		CreatedAt: time.Now().UTC(),
+	})
+
+	err = as.save()
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeToken removes the token with the given id.
+func (as *AuthStore) RevokeToken(tokenID string) error {
+	as.mtx.Lock()
+	defer as.mtx.Unlock()
+
+	err := as.reload()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range as.users {
+		for i, token := range user.Tokens {
+			if token.ID == tokenID {
+				user.Tokens = append(user.Tokens[:i], user.Tokens[i+1:]...)
+				return as.save()
+			}
+		}
+	}
+	return ErrTokenNotFound
+}
+
+// SetQuota sets the storage limits of the user.
+func (as *AuthStore) SetQuota(username string, quota Quota) error {
+	as.mtx.Lock()
+	defer as.mtx.Unlock()
+
+	err := as.reload()
+	if err != nil {
+		return err
+	}
+
+	user, ok := as.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user.Quota = quota
+	return as.save()
+}
+
+// RemoveUser removes the user together with all of its tokens.
+func (as *AuthStore) RemoveUser(username string) error {
+	as.mtx.Lock()
+	defer as.mtx.Unlock()
+
+	err := as.reload()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := as.users[username]; !ok {
+		return ErrUserNotFound
+	}
+	delete(as.users, username)
+	return as.save()
+}
+
+func (as *AuthStore) ListUsers() ([]User, error) {
+	as.mtx.Lock()
+	defer as.mtx.Unlock()
+
+	err := as.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(as.users))
+	for _, user := range as.users {
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users, nil
+}
+
+func getTokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func getRandomHex(numBytes int) (string, error) {
+	buffer := make([]byte, numBytes)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
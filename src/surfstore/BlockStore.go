@@ -2,13 +2,22 @@ package surfstore
 
 import (
 	"errors"
+	"sync"
+	"time"
 )
 
 type BlockStore struct {
 	BlockMap map[string]Block
+
+	mtx sync.RWMutex
+	// when each block was put, used by the garbage collection
+	storedAt map[string]time.Time
 }
 
 func (bs *BlockStore) GetBlock(blockHash string, blockData *Block) error {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+
 	block, ok := bs.BlockMap[blockHash]
 	if !ok {
 		return errors.New("block not found")
@@ -20,12 +29,26 @@ func (bs *BlockStore) GetBlock(blockHash string, blockData *Block) error {
 }
 
 func (bs *BlockStore) PutBlock(block Block, succ *bool) error {
-	bs.BlockMap[block.Hash()] = block
+	blockHash := block.Hash()
+
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	if _, ok := bs.BlockMap[blockHash]; !ok {
+		if bs.storedAt == nil {
+			bs.storedAt = make(map[string]time.Time)
+		}
+		bs.storedAt[blockHash] = time.Now()
+	}
+	bs.BlockMap[blockHash] = block
 	*succ = true
 	return nil
 }
 
 func (bs *BlockStore) HasBlocks(blockHashList []string, existedBlockHashList *[]string) error {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+
 	for _, blockHash := range blockHashList {
 		if _, ok := bs.BlockMap[blockHash]; ok {
 			*existedBlockHashList = append(*existedBlockHashList, blockHash)
@@ -36,9 +59,40 @@ func (bs *BlockStore) HasBlocks(blockHashList []string, existedBlockHashList *[]
 }
 
 func (bs *BlockStore) HasBlock(blockHash string, succ *bool) error {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+
 	_, *succ = bs.BlockMap[blockHash]
 	return nil
 }
 
+func (bs *BlockStore) GetBlockSize(blockHash string) (int, bool) {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+
+	block, ok := bs.BlockMap[blockHash]
+	return len(block.BlockData), ok
+}
+
+func (bs *BlockStore) ListBlocks() ([]BlockInfo, error) {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+
+	blocks := make([]BlockInfo, 0, len(bs.BlockMap))
+	for blockHash, block := range bs.BlockMap {
+		blocks = append(blocks, BlockInfo{Hash: blockHash, Size: len(block.BlockData), StoredAt: bs.storedAt[blockHash]})
+	}
+	return blocks, nil
+}
+
+func (bs *BlockStore) DeleteBlock(blockHash string) error {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+
+	delete(bs.BlockMap, blockHash)
+	delete(bs.storedAt, blockHash)
+	return nil
+}
+
 // This line guarantees all method for BlockStore are implemented
-var _ BlockStoreInterface = new(BlockStore)
+var _ BlockStorage = new(BlockStore)
@@ -0,0 +1,123 @@
+package surfstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The directory below the base directory where the client keeps its state.
+// It is never synced.
+const clientStateDir = ".surfstore"
+
+// ClientConfig holds the settings of a base directory, so they need not be
+// given with every command. It is stored in .surfstore/config in the same
+// format as the server config file:
+//
+//	server = "localhost:8080"
+//	block_size = 4096
+//	include = "docs,photos/2021"
+type ClientConfig struct {
+	Server    string
+	BlockSize int
+	Namespace string
+	CAFile    string
+	CertFile  string
+	KeyFile   string
+	// Selection is stored as comma separated prefixes
+	Selection SyncSelection
+	SafeLinks bool
+}
+
+func getClientConfigPath(baseDir string) string {
+	return filepath.Join(baseDir, clientStateDir, "config")
+}
+
+// LoadClientConfig reads the config of the base directory. A directory
+// without config has an empty one.
+func LoadClientConfig(baseDir string) (ClientConfig, error) {
+	var config ClientConfig
+	err := readConfigFile(getClientConfigPath(baseDir), func(key string, value string) (bool, error) {
+		var err error
+		switch key {
+		case "server":
+			config.Server = value
+		case "block_size":
+			config.BlockSize, err = strconv.Atoi(value)
+			if err == nil && config.BlockSize <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "namespace":
+			config.Namespace = value
+		case "ca":
+			config.CAFile = value
+		case "cert":
+			config.CertFile = value
+		case "key":
+			config.KeyFile = value
+		case "safe_links":
+			config.SafeLinks, err = strconv.ParseBool(value)
+		case "include":
+			config.Selection.Include = SplitSelectionPrefixes(value)
+		case "exclude":
+			config.Selection.Exclude = SplitSelectionPrefixes(value)
+		default:
+			return false, nil
+		}
+		return true, err
+	})
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	return config, err
+}
+
+// SaveClientConfig writes the config of the base directory, leaving out the
+// empty settings.
+func SaveClientConfig(baseDir string, config ClientConfig) error {
+	var buf bytes.Buffer
+	for _, setting := range []struct {
+		key   string
+		value string
+	}{
+		{"server", config.Server},
+		{"namespace", config.Namespace},
+		{"ca", config.CAFile},
+		{"cert", config.CertFile},
+		{"key", config.KeyFile},
+		{"include", strings.Join(config.Selection.Include, ",")},
+		{"exclude", strings.Join(config.Selection.Exclude, ",")},
+	} {
+		if setting.value != "" {
+			fmt.Fprintf(&buf, "%s = %s\n", setting.key, strconv.Quote(setting.value))
+		}
+	}
+	if config.BlockSize > 0 {
+		fmt.Fprintf(&buf, "block_size = %d\n", config.BlockSize)
+	}
+	if config.SafeLinks {
+		fmt.Fprintf(&buf, "safe_links = true\n")
+	}
+
+	err := os.MkdirAll(filepath.Join(baseDir, clientStateDir), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(getClientConfigPath(baseDir), buf.Bytes(), 0644)
+}
+
+// SplitSelectionPrefixes parses a comma separated list of folders.
+func SplitSelectionPrefixes(value string) []string {
+	var prefixes []string
+	for _, prefix := range strings.Split(value, ",") {
+		if strings.TrimSpace(prefix) != "" {
+			prefixes = append(prefixes, CleanSelectionPrefix(strings.TrimSpace(prefix)))
+		}
+	}
+	return prefixes
+}
@@ -0,0 +1,389 @@
+package surfstore
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of SurfstoreServerExec. It is read from an
+// optional config file and overridden by command line flags.
+type Config struct {
+	ListenAddr string
+
+	// Backend is "memory" or "disk". The disk backend keeps the blocks and
+	// the metadata journal in DataDir.
+	Backend   string
+	DataDir   string
+	UsersFile string
+
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+
+	UserQuota      int64
+	NamespaceQuota int64
+	MaxBlockSize   int64
+	MaxConnections int
+
+	LogFile   string
+	LogLevel  string
+	LogFormat string
+	// AuditLogFile enables the audit log of metadata changes
+	AuditLogFile string
+
+	ShutdownTimeout time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:      "localhost:8080",
+		Backend:         "memory",
+		LogLevel:        "info",
+		LogFormat:       "logfmt",
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// A configOption is a setting available both in the config file, as key in
+// its section, and as command line flag.
+type configOption struct {
+	key   string
+	flag  string
+	usage string
+	set   func(config *Config, value string) error
+}
+
+func setString(field func(config *Config) *string) func(*Config, string) error {
+	return func(config *Config, value string) error {
+		*field(config) = value
+		return nil
+	}
+}
+
+func setByteSize(field func(config *Config) *int64) func(*Config, string) error {
+	return func(config *Config, value string) (err error) {
+		*field(config), err = ParseByteSize(value)
+		return err
+	}
+}
+
+var configOptions = []configOption{
+	{"listen", "listen", "address to listen on (default localhost:8080)",
+		setString(func(c *Config) *string { return &c.ListenAddr })},
+	{"storage.backend", "backend", "storage backend, memory or disk (default memory)",
+		setString(func(c *Config) *string { return &c.Backend })},
+	{"storage.data_dir", "data-dir", "directory of the disk backend",
+		setString(func(c *Config) *string { return &c.DataDir })},
+	{"storage.users_file", "users", "user accounts file, enables token authentication",
+		setString(func(c *Config) *string { return &c.UsersFile })},
+	{"tls.cert", "tls-cert", "certificate file of the server, enables TLS",
+		setString(func(c *Config) *string { return &c.TLSCert })},
+	{"tls.key", "tls-key", "private key file of the server certificate",
+		setString(func(c *Config) *string { return &c.TLSKey })},
+	{"tls.client_ca", "tls-client-ca", "CA file to verify client certificates, enables mutual TLS",
+		setString(func(c *Config) *string { return &c.TLSClientCA })},
+	{"limits.user_quota", "user-quota", "default limit of the bytes uploaded by a user, e.g. 512M (default unlimited)",
+		setByteSize(func(c *Config) *int64 { return &c.UserQuota })},
+	{"limits.namespace_quota", "namespace-quota", "default limit of the size of all files in a namespace (default unlimited)",
+		setByteSize(func(c *Config) *int64 { return &c.NamespaceQuota })},
+	{"limits.max_block_size", "max-block-size", "largest block accepted from clients (default unlimited)",
+		setByteSize(func(c *Config) *int64 { return &c.MaxBlockSize })},
+	{"limits.max_connections", "max-connections", "maximum number of concurrent client connections (default unlimited)",
+		func(c *Config, value string) (err error) {
+			c.MaxConnections, err = strconv.Atoi(value)
+			return err
+		}},
+	{"log.file", "log-file", "file to append the log to (default stderr)",
+		setString(func(c *Config) *string { return &c.LogFile })},
+	{"log.audit_file", "audit-log", "file to append the audit log of file updates to (default disabled)",
+		setString(func(c *Config) *string { return &c.AuditLogFile })},
+	{"log.level", "log-level", "log entries of this level and above, debug, info, warn or error (default info)",
+		setString(func(c *Config) *string { return &c.LogLevel })},
+	{"log.format", "log-format", "log format, logfmt or json (default logfmt)",
+		setString(func(c *Config) *string { return &c.LogFormat })},
+	{"shutdown_timeout", "shutdown-timeout", "how long to wait for calls in flight on shutdown, e.g. 10s (default 30s)",
+		func(c *Config, value string) (err error) {
+			c.ShutdownTimeout, err = time.ParseDuration(value)
+			return err
+		}},
+}
+
+// RegisterConfigFlags adds a flag for every config option to the flag set.
+// The returned function applies the flags set on the command line to the
+// config, so they override the values of the config file.
+func RegisterConfigFlags(flags *flag.FlagSet) func(config *Config) error {
+	for _, option := range configOptions {
+		flags.String(option.flag, "", option.usage)
+	}
+
+	return func(config *Config) error {
+		var errs []string
+		flags.Visit(func(f *flag.Flag) {
+			for _, option := range configOptions {
+				if option.flag == f.Name {
+					err := option.set(config, f.Value.String())
+					if err != nil {
+						errs = append(errs, fmt.Sprintf("-%s: %v", f.Name, err))
+					}
+				}
+			}
+		})
+		if len(errs) > 0 {
+			return errors.New(strings.Join(errs, "\n"))
+		}
+		return nil
+	}
+}
+
+// LoadConfigFile reads a config file in a subset of TOML: "key = value"
+// lines grouped by [section] headers, with quoted strings, numbers and
+// booleans as values and "#" comments.
+//
+//	listen = "0.0.0.0:8080"
+//
+//	[storage]
+//	backend = "disk"
+//	data_dir = "/var/lib/surfstore"
+func LoadConfigFile(path string, config *Config) error {
+	return readConfigFile(path, func(key string, value string) (bool, error) {
+		for _, option := range configOptions {
+			if option.key == key {
+				return true, option.set(config, value)
+			}
+		}
+		return false, nil
+	})
+}
+
+// readConfigFile calls set with every key of the file, prefixed with its
+// section, and its unquoted value. set reports whether the key is known.
+func readConfigFile(path string, set func(key string, value string) (bool, error)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var errs []string
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		lineParts := strings.SplitN(line, "=", 2)
+		if len(lineParts) != 2 {
+			errs = append(errs, fmt.Sprintf("%s:%d: expected key = value", path, lineNum))
+			continue
+		}
+		key := strings.TrimSpace(lineParts[0])
+		if section != "" {
+			key = section + "." + key
+		}
+		value, err := parseConfigValue(strings.TrimSpace(lineParts[1]))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: %v", path, lineNum, err))
+			continue
+		}
+
+		found, err := set(key, value)
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s:%d: unknown key %s", path, lineNum, key))
+		} else if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: %s: %v", path, lineNum, key, err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// stripConfigComment removes a "#" comment outside of quoted strings.
+func stripConfigComment(line string) string {
+	inString := false
+	for i, c := range line {
+		switch {
+		case c == '"' && (i == 0 || line[i-1] != '\\'):
+			inString = !inString
+		case c == '#' && !inString:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseConfigValue(value string) (string, error) {
+	if strings.HasPrefix(value, "\"") {
+		return strconv.Unquote(value)
+	}
+	if strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) >= 2 {
+		return value[1 : len(value)-1], nil
+	}
+	if value == "true" || value == "false" {
+		return value, nil
+	}
+	if _, err := strconv.ParseInt(strings.Replace(value, "_", "", -1), 10, 64); err == nil {
+		return strings.Replace(value, "_", "", -1), nil
+	}
+	return "", errors.New("invalid value " + value)
+}
+
+// Validate checks the whole config and reports all problems at once.
+func (c *Config) Validate() error {
+	var errs []string
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Sprintf("listen: invalid address %q", c.ListenAddr))
+	}
+
+	switch c.Backend {
+	case "memory":
+	case "disk":
+		if c.DataDir == "" {
+			errs = append(errs, "storage.data_dir: required by the disk backend")
+		} else if err := checkDirWritable(c.DataDir); err != nil {
+			errs = append(errs, fmt.Sprintf("storage.data_dir: %v", err))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("storage.backend: unknown backend %q, must be memory or disk", c.Backend))
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, "tls: cert and key must be set together")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		errs = append(errs, "tls.client_ca: requires cert and key")
+	}
+	for _, file := range []struct{ key, path string }{
+		{"tls.cert", c.TLSCert}, {"tls.key", c.TLSKey}, {"tls.client_ca", c.TLSClientCA},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", file.key, err))
+		}
+	}
+
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Sprintf("log.level: %v", err))
+	}
+	if c.LogFormat != "logfmt" && c.LogFormat != "json" {
+		errs = append(errs, fmt.Sprintf("log.format: unknown format %q, must be logfmt or json", c.LogFormat))
+	}
+
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, "shutdown_timeout: must not be negative")
+	}
+	if c.MaxConnections < 0 {
+		errs = append(errs, "limits.max_connections: must not be negative")
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// checkDirWritable creates the directory if needed and checks that files
+// can be created in it.
+func checkDirWritable(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// NewSurfstoreServerFromConfig creates the server with the storage backend,
+// authentication, TLS and limits of the config. The config must be valid.
+func NewSurfstoreServerFromConfig(config Config) (Server, error) {
+	server := NewSurfstoreServer()
+
+	if config.Backend == "disk" {
+		blockStore, err := NewDiskBlockStore(filepath.Join(config.DataDir, "blocks"))
+		if err != nil {
+			return server, err
+		}
+		server.BlockStore = blockStore
+		server.Namespaces = NewNamespaceStore(blockStore)
+
+		// restore the metadata from the journal
+		journalPath := filepath.Join(config.DataDir, "journal")
+		err = replayJournal(journalPath, func(record JournalRecord) {
+			if record.Charge != nil {
+				server.Accounting.applyJournalRecord(record)
+			} else {
+				server.Namespaces.applyJournalRecord(record)
+			}
+		})
+		if err != nil {
+			return server, fmt.Errorf("failed to replay journal: %v", err)
+		}
+
+		records := append(server.Namespaces.getJournalRecords(), server.Accounting.getJournalRecords()...)
+		journal, err := openCompactedJournal(journalPath, records)
+		if err != nil {
+			return server, fmt.Errorf("failed to compact journal: %v", err)
+		}
+		server.Namespaces.setJournal(journal)
+		server.Accounting.setJournal(journal)
+		server.Journal = journal
+	}
+
+	if config.UsersFile != "" {
+		authStore, err := NewAuthStore(config.UsersFile)
+		if err != nil {
+			return server, fmt.Errorf("failed to load user accounts: %v", err)
+		}
+		server.Auth = authStore
+	}
+
+	if config.TLSCert != "" {
+		tlsConfig, err := NewServerTLSConfig(config.TLSCert, config.TLSKey, config.TLSClientCA)
+		if err != nil {
+			return server, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	if config.AuditLogFile != "" {
+		auditLog, err := OpenAuditLog(config.AuditLogFile)
+		if err != nil {
+			return server, fmt.Errorf("failed to open audit log: %v", err)
+		}
+		server.AuditLog = auditLog
+	}
+
+	server.DefaultQuota = Quota{PhysicalBytes: config.UserQuota, LogicalBytes: config.NamespaceQuota}
+	server.MaxBlockSize = config.MaxBlockSize
+	server.MaxConnections = config.MaxConnections
+	server.ShutdownTimeout = config.ShutdownTimeout
+	return server, nil
+}
@@ -0,0 +1,161 @@
+package surfstore
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DiskBlockStore keeps every block in its own file named by its hash, e.g.
+// blocks/ab/abcdef... for the block with hash abcdef...
+type DiskBlockStore struct {
+	Dir string
+}
+
+func NewDiskBlockStore(dir string) (*DiskBlockStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &DiskBlockStore{Dir: dir}, nil
+}
+
+// getBlockPath returns the path of the block file. The hash is checked first,
+// as it comes from the clients and must not be used to escape the directory.
+func (bs *DiskBlockStore) getBlockPath(blockHash string) (string, error) {
+	if len(blockHash) != 64 {
+		return "", errors.New("invalid block hash")
+	}
+	if _, err := hex.DecodeString(blockHash); err != nil {
+		return "", errors.New("invalid block hash")
+	}
+	return filepath.Join(bs.Dir, blockHash[:2], blockHash), nil
+}
+
+func (bs *DiskBlockStore) GetBlock(blockHash string, blockData *Block) error {
+	path, err := bs.getBlockPath(blockHash)
+	if err != nil {
+		return err
+	}
+
+	buffer, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return errors.New("block not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	*blockData = Block{BlockData: buffer, BlockSize: len(buffer)}
+	return nil
+}
+
+// PutBlock writes the block to a temporary file first and renames it, so
+// readers never see a partially written block.
+func (bs *DiskBlockStore) PutBlock(block Block, succ *bool) error {
+	*succ = false
+	path, err := bs.getBlockPath(block.Hash())
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		*succ = true
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".block-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(block.BlockData)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFile.Name(), path)
+	if err != nil {
+		return err
+	}
+	*succ = true
+	return nil
+}
+
+func (bs *DiskBlockStore) HasBlocks(blockHashList []string, existedBlockHashList *[]string) error {
+	for _, blockHash := range blockHashList {
+		if _, ok := bs.GetBlockSize(blockHash); ok {
+			*existedBlockHashList = append(*existedBlockHashList, blockHash)
+		}
+	}
+
+	return nil
+}
+
+func (bs *DiskBlockStore) HasBlock(blockHash string, succ *bool) error {
+	_, *succ = bs.GetBlockSize(blockHash)
+	return nil
+}
+
+func (bs *DiskBlockStore) GetBlockSize(blockHash string) (int, bool) {
+	path, err := bs.getBlockPath(blockHash)
+	if err != nil {
+		return 0, false
+	}
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	return int(fileInfo.Size()), true
+}
+
+// ListBlocks lists the block files, the time a block was stored is the
+// modification time of its file.
+func (bs *DiskBlockStore) ListBlocks() ([]BlockInfo, error) {
+	var blocks []BlockInfo
+	err := filepath.Walk(bs.Dir, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// skip directories and the temporary files of blocks being written
+		if !fileInfo.Mode().IsRegular() || strings.HasPrefix(fileInfo.Name(), ".") {
+			return nil
+		}
+		blocks = append(blocks, BlockInfo{Hash: fileInfo.Name(), Size: int(fileInfo.Size()), StoredAt: fileInfo.ModTime()})
+		return nil
+	})
+	return blocks, err
+}
+
+func (bs *DiskBlockStore) DeleteBlock(blockHash string) error {
+	path, err := bs.getBlockPath(blockHash)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// CheckHealth fails if no blocks can be written to the directory.
+func (bs *DiskBlockStore) CheckHealth() error {
+	return checkDirWritable(bs.Dir)
+}
+
+// This line guarantees all method for DiskBlockStore are implemented
+var _ BlockStorage = new(DiskBlockStore)
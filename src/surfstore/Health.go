@@ -0,0 +1,69 @@
+package surfstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// A healthChecker is a part of the storage backend that can fail at runtime,
+// e.g. the disk it writes to.
+type healthChecker interface {
+	CheckHealth() error
+}
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+// getReadinessChecks returns the checks that must pass for the server to
+// serve clients. The metadata is restored from the journal before the server
+// starts listening, so a listening server has replayed its journal.
+func (s *Server) getReadinessChecks() []healthCheck {
+	checks := []healthCheck{{"shutdown", func() error {
+		if s.conns != nil && s.conns.isDraining() {
+			return errors.New("server is shutting down")
+		}
+		return nil
+	}}}
+	if checker, ok := s.BlockStore.(healthChecker); ok {
+		checks = append(checks, healthCheck{"storage", checker.CheckHealth})
+	}
+	if s.Journal != nil {
+		checks = append(checks, healthCheck{"journal", s.Journal.CheckHealth})
+	}
+	if s.AuditLog != nil {
+		checks = append(checks, healthCheck{"audit_log", s.AuditLog.CheckHealth})
+	}
+	return checks
+}
+
+// ServeHealthz reports that the server is alive. It answers as long as the
+// server accepts HTTP requests.
+func (s *Server) ServeHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// ServeReadyz reports whether the server is able to serve clients, with the
+// result of every readiness check. It fails with 503 if any check fails.
+func (s *Server) ServeReadyz(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	status := http.StatusOK
+	for _, check := range s.getReadinessChecks() {
+		err := check.check()
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			fmt.Fprintf(&buf, "%s: %v\n", check.name, err)
+		} else {
+			fmt.Fprintf(&buf, "%s: ok\n", check.name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,193 @@
+package surfstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The name of the files listing the paths the client does not sync.
+const ignoreFilename = ".surfignore"
+
+// An ignorePattern is a line of a .surfignore file.
+type ignorePattern struct {
+	pattern string
+	// negate re-includes the paths an earlier pattern ignored
+	negate bool
+	// dirOnly patterns end with a slash and only match directories
+	dirOnly bool
+	// anchored patterns contain a slash and match the path relative to the
+	// directory of the .surfignore file, the others match the name at any
+	// depth
+	anchored bool
+}
+
+// IgnoreRules decides which paths of a base directory are ignored, following
+// the .surfignore files in the base directory and its sub directories. They
+// have the syntax of .gitignore files:
+//
+//	# editor and OS files
+//	*.swp
+//	!keep.swp
+//	.DS_Store
+//	node_modules/
+//	/build/
+//
+// A file is ignored if the last pattern matching it is not negated, looking
+// at the .surfignore files from the base directory down to the directory of
+// the file. Files in ignored directories are ignored, a negated pattern does
+// not include them again. Ignored files are neither uploaded nor overwritten
+// or deleted by downloads.
+type IgnoreRules struct {
+	baseDir string
+	// the patterns of the .surfignore file of each directory, loaded when
+	// a path below the directory is first checked
+	patterns    map[string][]ignorePattern
+	ignoredDirs map[string]bool
+}
+
+func LoadIgnoreRules(baseDir string) *IgnoreRules {
+	return &IgnoreRules{
+		baseDir:     baseDir,
+		patterns:    map[string][]ignorePattern{},
+		ignoredDirs: map[string]bool{},
+	}
+}
+
+// IsIgnored reports whether the file, given by its slash separated path
+// relative to the base directory, is ignored. nil rules ignore nothing.
+func (r *IgnoreRules) IsIgnored(filename string) bool {
+	return r.isIgnored(filename, false)
+}
+
+func (r *IgnoreRules) isIgnored(filename string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+	dir := path.Dir(filename)
+	if dir == "." {
+		dir = ""
+	}
+	if dir != "" && r.isIgnoredDir(dir) {
+		return true
+	}
+
+	ignored := false
+	for _, ruleDir := range getParentDirs(dir) {
+		relPath := filename
+		if ruleDir != "" {
+			relPath = strings.TrimPrefix(filename, ruleDir+"/")
+		}
+		for _, pattern := range r.getPatterns(ruleDir) {
+			if pattern.match(relPath, isDir) {
+				ignored = !pattern.negate
+			}
+		}
+	}
+	return ignored
+}
+
+func (r *IgnoreRules) isIgnoredDir(dir string) bool {
+	ignored, ok := r.ignoredDirs[dir]
+	if !ok {
+		ignored = r.isIgnored(dir, true)
+		r.ignoredDirs[dir] = ignored
+	}
+	return ignored
+}
+
+func (r *IgnoreRules) getPatterns(dir string) []ignorePattern {
+	patterns, ok := r.patterns[dir]
+	if ok {
+		return patterns
+	}
+	content, err := ioutil.ReadFile(filepath.Join(r.baseDir, filepath.FromSlash(dir), ignoreFilename))
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warn("failed to read ignore file", "dir", dir, "error", err)
+	}
+	patterns = parseIgnorePatterns(string(content))
+	r.patterns[dir] = patterns
+	return patterns
+}
+
+// getParentDirs returns the directory and its parents, starting with the base
+// directory "".
+func getParentDirs(dir string) []string {
+	dirs := []string{""}
+	if dir == "" {
+		return dirs
+	}
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		dirs = append(dirs, strings.Join(parts[:i+1], "/"))
+	}
+	return dirs
+}
+
+func parseIgnorePatterns(content string) []ignorePattern {
+	var patterns []ignorePattern
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(strings.TrimSuffix(line, "\r"), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var pattern ignorePattern
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			pattern.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		pattern.pattern = line
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// match reports whether the pattern matches the path relative to the
+// directory of its .surfignore file.
+func (p ignorePattern) match(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if !p.anchored {
+		matched, _ := path.Match(p.pattern, path.Base(relPath))
+		return matched
+	}
+	return matchPathSegments(strings.Split(p.pattern, "/"), strings.Split(relPath, "/"))
+}
+
+// matchPathSegments matches a path segment by segment, "**" matches any
+// number of segments.
+func matchPathSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchPathSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	matched, _ := path.Match(pattern[0], segments[0])
+	return matched && matchPathSegments(pattern[1:], segments[1:])
+}
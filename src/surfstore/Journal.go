@@ -0,0 +1,176 @@
+package surfstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A JournalRecord describes one change to the metadata of the server. Exactly
+// one of FileMeta, Batch, ACL and Charge is set.
+type JournalRecord struct {
+	Namespace string `json:",omitempty"`
+	// FileMeta replaces the entry of the file in the namespace
+	FileMeta *FileMetaData `json:",omitempty"`
+	// Batch replaces the entries of several files, written as one record so
+	// a crash keeps all or none of them
+	Batch []FileMetaData `json:",omitempty"`
+	// Purged removes the entry of FileMeta.Filename instead, leaving no tombstone
+	Purged bool `json:",omitempty"`
+	// ACL grants access to a shared folder, AccessNone removes the grant
+	ACL *ACLEntry `json:",omitempty"`
+	// Charge charges an uploaded block to an account
+	Charge *BlockCharge `json:",omitempty"`
+}
+
+type BlockCharge struct {
+	Account   string
+	BlockHash string
+	BlockSize int
+	Released  bool `json:",omitempty"`
+}
+
+// Journal is an append-only log of the metadata changes of the disk backend,
+// one JSON record per line. It is replayed on startup to restore the metadata
+// and then compacted to one record per file, grant and charge.
+type Journal struct {
+	Path string
+
+	mtx    sync.Mutex
+	file   *os.File
+	closed bool
+}
+
+// Append writes the record to the journal. Metadata changes are synced to
+// disk before Append returns, block charges are only synced by Sync, Close or
+// the next metadata change. A crash can lose the charges appended since then,
+// which only undercounts the usage of their accounts.
+func (j *Journal) Append(record JournalRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	if record.Charge == nil {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// Sync flushes the block charges appended since the last metadata change.
+func (j *Journal) Sync() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	return j.file.Sync()
+}
+
+func (j *Journal) Close() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	err := j.file.Sync()
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// CheckHealth fails once the journal is closed and changes can no longer be
+// persisted.
+func (j *Journal) CheckHealth() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if j.closed {
+		return errors.New("journal is closed")
+	}
+	return nil
+}
+
+// replayJournal calls apply with every record of the journal in order. A
+// missing journal has no records. A truncated last line, left behind by a
+// crash during a write, is ignored.
+func replayJournal(path string, apply func(record JournalRecord)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var record JournalRecord
+			if jsonErr := json.Unmarshal(line, &record); jsonErr != nil {
+				return jsonErr
+			}
+			apply(record)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// openCompactedJournal writes the records to a new journal replacing the one
+// at path and opens it for appending.
+func openCompactedJournal(path string, records []JournalRecord) (*Journal, error) {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".journal-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	writer := bufio.NewWriter(tmpFile)
+	encoder := json.NewEncoder(writer)
+	for _, record := range records {
+		err = encoder.Encode(record)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Rename(tmpFile.Name(), path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{Path: path, file: file}, nil
+}
@@ -0,0 +1,90 @@
+package surfstore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// localBlockIndex locates the blocks of the local files by hash, so a
+// download copies the blocks present in any local file instead of getting
+// them from the server, e.g. when a file was copied or shares blocks with
+// another one.
+type localBlockIndex map[string]localBlockLocation
+
+type localBlockLocation struct {
+	filename string
+	offset   int64
+}
+
+// newLocalBlockIndex indexes the blocks of the files of the index updated
+// with the local changes, whose block hash lists come from the scan and the
+// stat cache.
+func newLocalBlockIndex(client RPCClient, fileMetaMap map[string]*FileMetaData) localBlockIndex {
+	index := make(localBlockIndex)
+	for _, fileMeta := range fileMetaMap {
+		index.addFile(client, fileMeta)
+	}
+	return index
+}
+
+// addFile adds the blocks of a file written locally.
+func (index localBlockIndex) addFile(client RPCClient, fileMeta *FileMetaData) {
+	if fileMeta.IsTombstone() || fileMeta.IsSymlink() || fileMeta.excluded {
+		return
+	}
+	for i, blockHash := range fileMeta.BlockHashList {
+		if _, ok := index[blockHash]; !ok {
+			index[blockHash] = localBlockLocation{fileMeta.Filename, int64(i) * int64(client.BlockSize)}
+		}
+	}
+}
+
+// localBlockReader reads blocks from the local files, keeping the files open
+// until it is closed.
+type localBlockReader struct {
+	client RPCClient
+	index  localBlockIndex
+	files  map[string]*os.File
+}
+
+func (index localBlockIndex) newReader(client RPCClient) *localBlockReader {
+	return &localBlockReader{client: client, index: index, files: map[string]*os.File{}}
+}
+
+// readBlock returns the block if a local file has it, nil if not. The files
+// may have changed since they were indexed, so the hash of the block read is
+// checked.
+func (r *localBlockReader) readBlock(blockHash string) *Block {
+	location, ok := r.index[blockHash]
+	if !ok {
+		return nil
+	}
+	file, ok := r.files[location.filename]
+	if !ok {
+		var err error
+		file, err = os.Open(filepath.Join(r.client.BaseDir, filepath.FromSlash(location.filename)))
+		if err != nil {
+			return nil
+		}
+		r.files[location.filename] = file
+	}
+
+	block := NewBlock(r.client.BlockSize)
+	readBlockSize, err := file.ReadAt(block.BlockData, location.offset)
+	if err != nil && err != io.EOF {
+		return nil
+	}
+	block.BlockData = block.BlockData[:readBlockSize]
+	block.BlockSize = readBlockSize
+	if block.Hash() != blockHash {
+		return nil
+	}
+	return &block
+}
+
+func (r *localBlockReader) close() {
+	for _, file := range r.files {
+		file.Close()
+	}
+}
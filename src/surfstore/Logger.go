@@ -0,0 +1,204 @@
+package surfstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The HTTP header a client sends the ID of its sync with, so the server logs
+// of the calls of one sync can be found by the ID.
+const requestIDHeader = "X-Request-Id"
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, errors.New("invalid log level, must be debug, info, warn or error")
+	}
+}
+
+// logOutput is shared by a logger and the loggers derived from it with With.
+type logOutput struct {
+	mtx    sync.Mutex
+	out    io.Writer
+	level  LogLevel
+	isJSON bool
+}
+
+// Logger writes structured log entries, one per line, either in logfmt
+//
+//	time=2021-03-04T05:06:07.089Z level=info msg="file updated" file=a.txt version=2
+//
+// or as JSON objects with the same keys.
+type Logger struct {
+	output *logOutput
+	// key value pairs added to every entry
+	fields []interface{}
+}
+
+// NewLogger creates a logger writing the entries of the level and above to
+// out. The format is "logfmt" or "json".
+func NewLogger(out io.Writer, level LogLevel, format string) (*Logger, error) {
+	if format != "logfmt" && format != "json" {
+		return nil, errors.New("invalid log format, must be logfmt or json")
+	}
+	return &Logger{output: &logOutput{out: out, level: level, isJSON: format == "json"}}, nil
+}
+
+// logger is the logger of the package, see SetLogger.
+var logger = &Logger{output: &logOutput{out: os.Stderr, level: LevelInfo}}
+
+// SetLogger replaces the logger of the package. It must be called before the
+// client or server is started.
+func SetLogger(l *Logger) {
+	logger = l
+}
+
+// With returns a logger adding the key value pairs to every entry.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(append(fields, l.fields...), keyvals...)
+	return &Logger{output: l.output, fields: fields}
+}
+
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= l.output.level
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+func (l *Logger) log(level LogLevel, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var buf bytes.Buffer
+	entry := append([]interface{}{
+		"time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		"level", level.String(),
+		"msg", msg,
+	}, l.fields...)
+	entry = append(entry, keyvals...)
+	if len(entry)%2 != 0 {
+		entry = append(entry, "")
+	}
+
+	if l.output.isJSON {
+		buf.WriteByte('{')
+		for i := 0; i < len(entry); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(fmt.Sprint(entry[i]))
+			value, err := json.Marshal(formatLogValue(entry[i+1]))
+			if err != nil {
+				value, _ = json.Marshal(fmt.Sprint(entry[i+1]))
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+		buf.WriteString("}\n")
+	} else {
+		for i := 0; i < len(entry); i += 2 {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(fmt.Sprint(entry[i]))
+			buf.WriteByte('=')
+			buf.WriteString(quoteLogfmtValue(fmt.Sprint(formatLogValue(entry[i+1]))))
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.output.mtx.Lock()
+	defer l.output.mtx.Unlock()
+	_, _ = l.output.out.Write(buf.Bytes())
+}
+
+// formatLogValue turns errors and durations into strings, other values are
+// written as they are.
+func formatLogValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return value
+	}
+}
+
+func quoteLogfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// NewRequestID returns a random ID to correlate the log entries of a sync.
+func NewRequestID() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// isValidRequestID accepts the IDs of clients that are safe to log.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
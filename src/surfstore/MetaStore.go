@@ -2,34 +2,506 @@ package surfstore
 
 import (
 	"errors"
+	"sync"
 )
 
+// The number of previous versions kept of every file, see GetFileHistory.
+const maxHistoryVersions = 10
+
 type MetaStore struct {
 	FileMetaMap map[string]FileMetaData
+	// History holds the previous versions of each file, oldest first
+	History map[string][]FileMetaData
+	// ACL maps each shared folder to the access granted to its collaborators
+	ACL map[string]map[string]Access
+
+	mtx sync.Mutex
+	// the files referring to each block, with the number of their versions
+	// referring to it, including previous versions
+	blockRefs map[string]map[string]int
+	// blocks put into the namespace, by the accounts that put them
+	storedBlocks map[string]map[string]bool
+	// the block store is only used to look up the size of blocks
+	blockStore BlockStorage
+	// logical size of each file and their sum, see Usage
+	fileSizes    map[string]int64
+	logicalBytes int64
+	// limit of logicalBytes, 0 means unlimited
+	quota int64
+	// number of updates rejected because they were not newer, see GetStats
+	conflicts int64
+	// changes are written to the journal when it is set
+	namespace string
+	journal   *Journal
+}
+
+func NewMetaStore(blockStore BlockStorage) *MetaStore {
+	return &MetaStore{
+		FileMetaMap:  map[string]FileMetaData{},
+		History:      map[string][]FileMetaData{},
+		ACL:          map[string]map[string]Access{},
+		blockRefs:    map[string]map[string]int{},
+		storedBlocks: map[string]map[string]bool{},
+		blockStore:   blockStore,
+		fileSizes:    map[string]int64{},
+	}
 }
 
 func (m *MetaStore) GetFileInfoMap(_ignore *bool, serverFileInfoMap *map[string]FileMetaData) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
 	for key, element := range m.FileMetaMap {
 		(*serverFileInfoMap)[key] = element
 	}
 	return nil
 }
 
-func (m *MetaStore) UpdateFile(newFileMeta *FileMetaData, latestVersion *int) (err error) {
-	filename := newFileMeta.Filename
-	if fileMeta, ok := m.FileMetaMap[filename]; ok {
-		if newFileMeta.Version > fileMeta.Version {
-			(m.FileMetaMap)[filename] = (*newFileMeta)
-			*latestVersion = newFileMeta.Version
-		} else if newFileMeta.Version < fileMeta.Version {
-			err = errors.New("trying to update an older version")
-		}
-	} else {
-		m.FileMetaMap[filename] = (*newFileMeta)
+// UpdateFile is the UpdateFile of clients that do not know UpdateFileV2: it
+// sets latestVersion to the new version if it was stored, leaves it unchanged
+// if the version already exists and fails if the version was rejected for
+// another reason.
+func (m *MetaStore) UpdateFile(newFileMeta *FileMetaData, latestVersion *int) error {
+	var result UpdateResult
+	err := m.UpdateFileV2(newFileMeta, &result)
+	return toLatestVersion(newFileMeta, &result, latestVersion, err)
+}
+
+// toLatestVersion turns the result of UpdateFileV2 into the one of UpdateFile.
+func toLatestVersion(newFileMeta *FileMetaData, result *UpdateResult, latestVersion *int, err error) error {
+	switch {
+	case err != nil:
+		return err
+	case result.Accepted:
 		*latestVersion = newFileMeta.Version
+	case result.Reason != RejectedSameVersion:
+		return errors.New(string(result.Reason))
 	}
+	return nil
+}
+
+// UpdateFileV2 stores the new version of the file if it is newer than the one
+// stored and based on it. Other versions are rejected, which is not an
+// error; the errors are failures to store the version.
+func (m *MetaStore) UpdateFileV2(newFileMeta *FileMetaData, result *UpdateResult) error {
+	return m.updateFile(newFileMeta, result, noAudit)
+}
+
+// An auditFunc records updates of files in the audit log, reasons[i] tells why
+// the update of fileMetas[i] was rejected or is empty if it was accepted.
+// oldVersions are the versions before the updates, 0 for new files. The
+// MetaStore calls it with its lock held, so the audit log lists the updates in
+// the order they were applied, and only applies updates it could audit.
+type auditFunc func(fileMetas []FileMetaData, oldVersions []int, reasons []string) error
+
+func noAudit([]FileMetaData, []int, []string) error {
+	return nil
+}
+
+// updateFile is UpdateFileV2 that also audits the update.
+func (m *MetaStore) updateFile(newFileMeta *FileMetaData, result *UpdateResult, audit auditFunc) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
 
-	return err
+	*result = UpdateResult{}
+	fileMeta, ok := m.FileMetaMap[newFileMeta.Filename]
+	auditAs := func(reason string) error {
+		return audit([]FileMetaData{*newFileMeta}, []int{fileMeta.Version}, []string{reason})
+	}
+	if reason := checkNewVersion(newFileMeta, fileMeta, ok); reason != "" {
+		m.conflicts++
+		*result = UpdateResult{Current: fileMeta, Reason: reason}
+		_ = auditAs(string(reason))
+		return nil
+	}
+
+	err := m.checkQuota([]FileMetaData{*newFileMeta})
+	if err != nil {
+		_ = auditAs(err.Error())
+		return err
+	}
+	err = auditAs("")
+	if err != nil {
+		return err
+	}
+	err = m.setFileMeta(*newFileMeta)
+	if err != nil {
+		// the update was already audited as accepted
+		_ = auditAs(err.Error())
+		return err
+	}
+	*result = UpdateResult{Accepted: true, Current: *newFileMeta}
+	return nil
+}
+
+// checkNewVersion returns why the new version of a file must be rejected, or
+// "" if it is newer than the current one, which exists if ok is set, and
+// based on it if it has a base version. If both have version vectors, the
+// new one must also include all changes of the current one.
+func checkNewVersion(newFileMeta *FileMetaData, fileMeta FileMetaData, ok bool) RejectReason {
+	switch {
+	case ok && newFileMeta.Version < fileMeta.Version:
+		return RejectedOlderVersion
+	case ok && newFileMeta.Version == fileMeta.Version:
+		return RejectedSameVersion
+	case ok && len(newFileMeta.Vector) > 0 && len(fileMeta.Vector) > 0 &&
+		newFileMeta.Vector.Compare(fileMeta.Vector) != VectorDescendant:
+		return RejectedConcurrentVersion
+	case newFileMeta.HasBaseVersion && newFileMeta.BaseVersion != fileMeta.Version:
+		return RejectedBaseVersion
+	default:
+		return ""
+	}
+}
+
+// UpdateFiles stores new versions of several files at once, so readers see
+// either all or none of them. The batch is rejected if any of the versions is
+// not newer than the one stored or not based on it, result then lists these
+// files.
+func (m *MetaStore) UpdateFiles(fileMetas []FileMetaData, result *UpdateFilesResult) error {
+	return m.updateFiles(fileMetas, result, noAudit)
+}
+
+// updateFiles is UpdateFiles that also audits the update of every file.
+func (m *MetaStore) updateFiles(fileMetas []FileMetaData, result *UpdateFilesResult, audit auditFunc) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	*result = UpdateFilesResult{}
+	oldVersions := make([]int, len(fileMetas))
+	auditAs := func(reason func(i int) string) error {
+		reasons := make([]string, len(fileMetas))
+		for i := range fileMetas {
+			reasons[i] = reason(i)
+		}
+		return audit(fileMetas, oldVersions, reasons)
+	}
+	reject := func(err error) error {
+		_ = auditAs(func(int) string { return err.Error() })
+		return err
+	}
+
+	updated := make(map[string]bool)
+	for i, fileMeta := range fileMetas {
+		if updated[fileMeta.Filename] {
+			return reject(errors.New("file " + fileMeta.Filename + " updated twice"))
+		}
+		updated[fileMeta.Filename] = true
+
+		currentFileMeta, ok := m.FileMetaMap[fileMeta.Filename]
+		oldVersions[i] = currentFileMeta.Version
+		if reason := checkNewVersion(&fileMetas[i], currentFileMeta, ok); reason != "" {
+			result.Conflicts = append(result.Conflicts, FileConflict{
+				Filename: fileMeta.Filename,
+				Version:  fileMeta.Version,
+				Current:  currentFileMeta,
+				Reason:   reason,
+			})
+		}
+	}
+	if len(result.Conflicts) > 0 {
+		m.conflicts += int64(len(result.Conflicts))
+		reasons := make(map[string]string)
+		for _, conflict := range result.Conflicts {
+			reasons[conflict.Filename] = string(conflict.Reason)
+		}
+		_ = auditAs(func(i int) string {
+			if reason, ok := reasons[fileMetas[i].Filename]; ok {
+				return reason
+			}
+			return "batch rejected"
+		})
+		return nil
+	}
+
+	err := m.checkQuota(fileMetas)
+	if err != nil {
+		return reject(err)
+	}
+	err = auditAs(func(int) string { return "" })
+	if err != nil {
+		return err
+	}
+	if m.journal != nil && len(fileMetas) > 0 {
+		err = m.journal.Append(JournalRecord{Namespace: m.namespace, Batch: fileMetas})
+		if err != nil {
+			// the updates were already audited as accepted
+			return reject(err)
+		}
+	}
+	for _, fileMeta := range fileMetas {
+		m.applyFileMeta(fileMeta)
+	}
+	result.Accepted = true
+	return nil
+}
+
+// SetQuota limits the logical bytes of the files in the store, 0 means
+// unlimited. Updates that would exceed the quota are rejected, updates that
+// shrink the files are always accepted.
+func (m *MetaStore) SetQuota(quota int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.quota = quota
+}
+
+// GetLogicalBytes returns the sum of the sizes of all files and the quota.
+func (m *MetaStore) GetLogicalBytes() (logicalBytes int64, quota int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.logicalBytes, m.quota
+}
+
+// GetStats returns the number of file entries, including tombstones, and the
+// number of updates rejected because the file had changed in the meantime.
+func (m *MetaStore) GetStats() (entries int, conflicts int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return len(m.FileMetaMap), m.conflicts
+}
+
+// checkQuota fails if storing the files would grow them beyond the quota.
+// The caller must hold the lock.
+func (m *MetaStore) checkQuota(fileMetas []FileMetaData) error {
+	if m.quota <= 0 {
+		return nil
+	}
+	var growth int64
+	for i := range fileMetas {
+		growth += m.getFileSize(&fileMetas[i]) - m.fileSizes[fileMetas[i].Filename]
+	}
+	if growth > 0 && m.logicalBytes+growth > m.quota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func (m *MetaStore) getFileSize(fileMeta *FileMetaData) int64 {
+	if fileMeta.IsTombstone() {
+		return 0
+	}
+	var fileSize int64
+	for _, blockHash := range fileMeta.BlockHashList {
+		blockSize, _ := m.blockStore.GetBlockSize(blockHash)
+		fileSize += int64(blockSize)
+	}
+	return fileSize
+}
+
+// GetFileHistory returns the versions kept of the file, oldest first and
+// ending with the current version.
+func (m *MetaStore) GetFileHistory(filename string) []FileMetaData {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.getVersions(filename)
+}
+
+// getVersions is GetFileHistory for callers holding the lock. It returns a
+// copy, so appending to it does not change the history.
+func (m *MetaStore) getVersions(filename string) []FileMetaData {
+	fileMeta, ok := m.FileMetaMap[filename]
+	if !ok {
+		return nil
+	}
+	versions := append([]FileMetaData(nil), m.History[filename]...)
+	return append(versions, fileMeta)
+}
+
+// HasBlockReference reports whether any file in the store refers to the block.
+func (m *MetaStore) HasBlockReference(blockHash string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return len(m.blockRefs[blockHash]) > 0
+}
+
+// addStoredBlock records that the account put the block into the namespace.
+func (m *MetaStore) addStoredBlock(blockHash string, account string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, ok := m.storedBlocks[blockHash]; !ok {
+		m.storedBlocks[blockHash] = make(map[string]bool)
+	}
+	m.storedBlocks[blockHash][account] = true
+}
+
+// HasStoredBlock reports whether the account put the block into the
+// namespace, any account if account is "", or whether a file in the store
+// refers to it.
+func (m *MetaStore) HasStoredBlock(blockHash string, account string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if account == "" {
+		return len(m.storedBlocks[blockHash]) > 0 || len(m.blockRefs[blockHash]) > 0
+	}
+	return m.storedBlocks[blockHash][account]
+}
+
+// removeStoredBlock forgets a block deleted from the block store.
+func (m *MetaStore) removeStoredBlock(blockHash string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	delete(m.storedBlocks, blockHash)
+}
+
+// getFileSizeOf returns the logical size of the file, 0 for deleted files.
+func (m *MetaStore) getFileSizeOf(filename string) int64 {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.fileSizes[filename]
+}
+
+// addBlockReferences adds the blocks referred to by the files to the set.
+func (m *MetaStore) addBlockReferences(blockHashes map[string]bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for blockHash := range m.blockRefs {
+		blockHashes[blockHash] = true
+	}
+}
+
+// HasBlockReferenceIn reports whether any file accepted by the filter refers
+// to the block, in its current or a previous version. Only the files referring
+// to the block are passed to the filter.
+func (m *MetaStore) HasBlockReferenceIn(blockHash string, filter func(filename string) bool) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for filename := range m.blockRefs[blockHash] {
+		if filter(filename) {
+			return true
+		}
+	}
+	return false
+}
+
+// setFileMeta writes the new entry of the file to the journal and applies
+// it. The caller must hold the lock.
+func (m *MetaStore) setFileMeta(fileMeta FileMetaData) error {
+	if m.journal != nil {
+		err := m.journal.Append(JournalRecord{Namespace: m.namespace, FileMeta: &fileMeta})
+		if err != nil {
+			return err
+		}
+	}
+	m.applyFileMeta(fileMeta)
+	return nil
+}
+
+// applyFileMeta replaces the entry of the file, moving the previous entry to
+// the history, and keeps the block references up to date. The caller must
+// hold the lock.
+func (m *MetaStore) applyFileMeta(fileMeta FileMetaData) {
+	if oldFileMeta, ok := m.FileMetaMap[fileMeta.Filename]; ok {
+		history := append(m.History[fileMeta.Filename], oldFileMeta)
+		if len(history) > maxHistoryVersions {
+			m.removeBlockReferences(&history[0])
+			history = history[1:]
+		}
+		m.History[fileMeta.Filename] = history
+	}
+	if !fileMeta.IsTombstone() {
+		for _, blockHash := range fileMeta.BlockHashList {
+			if _, ok := m.blockRefs[blockHash]; !ok {
+				m.blockRefs[blockHash] = make(map[string]int)
+			}
+			m.blockRefs[blockHash][fileMeta.Filename]++
+		}
+	}
+	m.FileMetaMap[fileMeta.Filename] = fileMeta
+
+	fileSize := m.getFileSize(&fileMeta)
+	m.logicalBytes += fileSize - m.fileSizes[fileMeta.Filename]
+	m.fileSizes[fileMeta.Filename] = fileSize
+}
+
+// removeBlockReferences drops the references of a version of a file that is
+// no longer kept. The caller must hold the lock.
+func (m *MetaStore) removeBlockReferences(fileMeta *FileMetaData) {
+	if fileMeta.IsTombstone() {
+		return
+	}
+	for _, blockHash := range fileMeta.BlockHashList {
+		fileRefs, ok := m.blockRefs[blockHash]
+		if !ok {
+			continue
+		}
+		fileRefs[fileMeta.Filename]--
+		if fileRefs[fileMeta.Filename] <= 0 {
+			delete(fileRefs, fileMeta.Filename)
+		}
+		if len(fileRefs) == 0 {
+			delete(m.blockRefs, blockHash)
+		}
+	}
+}
+
+// PurgeFile removes every trace of the file including its history, unlike a
+// deletion, which keeps a tombstone. Clients that still have the file will upload it again.
+func (m *MetaStore) PurgeFile(filename string) (bool, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if _, ok := m.FileMetaMap[filename]; !ok {
+		return false, nil
+	}
+	if m.journal != nil {
+		record := JournalRecord{Namespace: m.namespace, FileMeta: &FileMetaData{Filename: filename}, Purged: true}
+		err := m.journal.Append(record)
+		if err != nil {
+			return false, err
+		}
+	}
+	m.applyPurge(filename)
+	return true, nil
+}
+
+// applyPurge removes the entry of the file. The caller must hold the lock.
+func (m *MetaStore) applyPurge(filename string) {
+	if _, ok := m.FileMetaMap[filename]; !ok {
+		return
+	}
+	for _, version := range m.getVersions(filename) {
+		version := version
+		m.removeBlockReferences(&version)
+	}
+	m.logicalBytes -= m.fileSizes[filename]
+	delete(m.FileMetaMap, filename)
+	delete(m.History, filename)
+	delete(m.fileSizes, filename)
+}
+
+// getJournalRecords returns the records restoring the current state of the
+// store, used to compact the journal.
+func (m *MetaStore) getJournalRecords() []JournalRecord {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	// the previous versions come first, so replaying the records restores
+	// the history as well
+	var records []JournalRecord
+	for filename := range m.FileMetaMap {
+		for _, version := range m.getVersions(filename) {
+			version := version
+			records = append(records, JournalRecord{Namespace: m.namespace, FileMeta: &version})
+		}
+	}
+	for folder, users := range m.ACL {
+		for username, access := range users {
+			entry := ACLEntry{Folder: folder, User: username, Access: access}
+			records = append(records, JournalRecord{Namespace: m.namespace, ACL: &entry})
+		}
+	}
+	return records
 }
 
 var _ MetaStoreInterface = new(MetaStore)
@@ -0,0 +1,247 @@
+package surfstore
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The upper bounds in seconds of the buckets of the RPC latency histograms.
+var rpcDurationBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// rpcMethods are the methods clients can call. Calls of other methods are
+// recorded as "other", so clients cannot create arbitrary label values. The
+// methods of the Server service are recorded without the service name.
+var rpcMethods = getRPCMethods()
+
+func getRPCMethods() map[string]bool {
+	methods := make(map[string]bool)
+	for service, receiver := range map[string]interface{}{"Server": new(Session), "Admin": new(AdminSession)} {
+		receiverType := reflect.TypeOf(receiver)
+		for i := 0; i < receiverType.NumMethod(); i++ {
+			methods[service+"."+receiverType.Method(i).Name] = true
+		}
+	}
+	return methods
+}
+
+type histogram struct {
+	// counts of the observations per bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(value float64) {
+	i := sort.SearchFloat64s(rpcDurationBuckets, value)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+type rpcCallKey struct {
+	method string
+	failed bool
+}
+
+// Metrics collects the RPC calls served by the server and the blocks stored.
+// The state of the metadata stores is read when the metrics are scraped.
+type Metrics struct {
+	mtx          sync.Mutex
+	rpcCalls     map[rpcCallKey]uint64
+	rpcDurations map[string]*histogram
+	// the blocks in the block store and their bytes, counted when the server
+	// starts and updated by PutBlock and the garbage collection
+	blocks     int64
+	blockBytes int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		rpcCalls:     map[rpcCallKey]uint64{},
+		rpcDurations: map[string]*histogram{},
+	}
+}
+
+func (m *Metrics) observeRPC(serviceMethod string, duration time.Duration, failed bool) {
+	if m == nil {
+		return
+	}
+	method := "other"
+	if rpcMethods[serviceMethod] {
+		method = strings.TrimPrefix(serviceMethod, "Server.")
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.rpcCalls[rpcCallKey{method, failed}]++
+	h, ok := m.rpcDurations[method]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(rpcDurationBuckets))}
+		m.rpcDurations[method] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// setBlocks replaces the block counts with the blocks listed by the block
+// store.
+func (m *Metrics) setBlocks(blocks []BlockInfo) {
+	if m == nil {
+		return
+	}
+	var blockBytes int64
+	for _, block := range blocks {
+		blockBytes += int64(block.Size)
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.blocks = int64(len(blocks))
+	m.blockBytes = blockBytes
+}
+
+// addBlock counts a block new to the block store.
+func (m *Metrics) addBlock(size int) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.blocks++
+	m.blockBytes += int64(size)
+}
+
+// removeBlock uncounts a block deleted from the block store.
+func (m *Metrics) removeBlock(size int) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.blocks--
+	m.blockBytes -= int64(size)
+}
+
+func (m *Metrics) getBlocks() (blocks int64, blockBytes int64) {
+	if m == nil {
+		return 0, 0
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.blocks, m.blockBytes
+}
+
+// writeRPCMetrics writes the RPC counters and histograms sorted by method.
+func (m *Metrics) writeRPCMetrics(buf *bytes.Buffer) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	keys := make([]rpcCallKey, 0, len(m.rpcCalls))
+	for key := range m.rpcCalls {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return !keys[i].failed && keys[j].failed
+	})
+	writeMetricHeader(buf, "surfstore_rpc_calls_total", "counter", "RPC calls served, by method and result.")
+	for _, key := range keys {
+		result := "ok"
+		if key.failed {
+			result = "error"
+		}
+		fmt.Fprintf(buf, "surfstore_rpc_calls_total{method=%s,result=%q} %d\n",
+			strconv.Quote(key.method), result, m.rpcCalls[key])
+	}
+
+	methods := make([]string, 0, len(m.rpcDurations))
+	for method := range m.rpcDurations {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	writeMetricHeader(buf, "surfstore_rpc_duration_seconds", "histogram", "Time spent serving RPC calls, by method.")
+	for _, method := range methods {
+		h := m.rpcDurations[method]
+		label := strconv.Quote(method)
+		var cumulative uint64
+		for i, bound := range rpcDurationBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(buf, "surfstore_rpc_duration_seconds_bucket{method=%s,le=%q} %d\n",
+				label, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(buf, "surfstore_rpc_duration_seconds_bucket{method=%s,le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(buf, "surfstore_rpc_duration_seconds_sum{method=%s} %g\n", label, h.sum)
+		fmt.Fprintf(buf, "surfstore_rpc_duration_seconds_count{method=%s} %d\n", label, h.count)
+	}
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name string, metricType string, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeMetric(buf *bytes.Buffer, name string, metricType string, help string, value float64) {
+	writeMetricHeader(buf, name, metricType, help)
+	fmt.Fprintf(buf, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// ServeMetrics serves the metrics in the Prometheus text format.
+func (s *Server) ServeMetrics(w http.ResponseWriter, req *http.Request) {
+	// the blocks actually stored, the charges of the accounting can miss
+	// blocks whose charge was lost in a crash
+	blocks, blockBytes := s.Metrics.getBlocks()
+
+	var buf bytes.Buffer
+	if s.Metrics != nil {
+		s.Metrics.writeRPCMetrics(&buf)
+	}
+
+	var entries int
+	var conflicts, logicalBytes int64
+	namespaces := s.Namespaces.List()
+	for _, namespace := range namespaces {
+		metaStore, ok := s.Namespaces.Lookup(namespace)
+		if !ok {
+			continue
+		}
+		namespaceEntries, namespaceConflicts := metaStore.GetStats()
+		namespaceBytes, _ := metaStore.GetLogicalBytes()
+		entries += namespaceEntries
+		conflicts += namespaceConflicts
+		logicalBytes += namespaceBytes
+	}
+	dedupRatio := 1.0
+	if blockBytes > 0 {
+		dedupRatio = float64(logicalBytes) / float64(blockBytes)
+	}
+
+	writeMetric(&buf, "surfstore_update_conflicts_total", "counter",
+		"File updates rejected because the file has a newer or the same version.", float64(conflicts))
+	writeMetric(&buf, "surfstore_active_connections", "gauge",
+		"Client connections being served.", float64(atomic.LoadInt64(&s.activeConnections)))
+	writeMetric(&buf, "surfstore_blocks", "gauge", "Blocks stored.", float64(blocks))
+	writeMetric(&buf, "surfstore_block_bytes", "gauge", "Bytes of the blocks stored.", float64(blockBytes))
+	writeMetric(&buf, "surfstore_logical_bytes", "gauge", "Total size of the files of all namespaces.", float64(logicalBytes))
+	writeMetric(&buf, "surfstore_dedup_ratio", "gauge", "Logical bytes per stored block byte.", dedupRatio)
+	writeMetric(&buf, "surfstore_metadata_entries", "gauge",
+		"File entries of all namespaces, including deleted files.", float64(entries))
+	writeMetric(&buf, "surfstore_namespaces", "gauge", "Namespaces with metadata.", float64(len(namespaces)))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,152 @@
+package surfstore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidNamespace = errors.New("invalid namespace")
+
+// NamespaceStore partitions the file metadata by tenant. Every namespace has
+// its own MetaStore, while the blocks are deduplicated across all namespaces.
+// The namespace "" is used by clients when authentication is disabled.
+type NamespaceStore struct {
+	MetaStores map[string]*MetaStore
+
+	mtx        sync.Mutex
+	blockStore BlockStorage
+	journal    *Journal
+	// held for writing by the garbage collection, see Server.CollectGarbage
+	gcMtx sync.RWMutex
+}
+
+func NewNamespaceStore(blockStore BlockStorage) *NamespaceStore {
+	return &NamespaceStore{MetaStores: map[string]*MetaStore{}, blockStore: blockStore}
+}
+
+// Get returns the MetaStore of the namespace, creating it on first use.
+func (ns *NamespaceStore) Get(namespace string) *MetaStore {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+
+	metaStore, ok := ns.MetaStores[namespace]
+	if !ok {
+		metaStore = NewMetaStore(ns.blockStore)
+		metaStore.namespace = namespace
+		metaStore.journal = ns.journal
+		ns.MetaStores[namespace] = metaStore
+	}
+	return metaStore
+}
+
+// Lookup returns the MetaStore of the namespace if it exists.
+func (ns *NamespaceStore) Lookup(namespace string) (*MetaStore, bool) {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+
+	metaStore, ok := ns.MetaStores[namespace]
+	return metaStore, ok
+}
+
+// applyJournalRecord restores the change of a journal record without writing
+// it to the journal again.
+func (ns *NamespaceStore) applyJournalRecord(record JournalRecord) {
+	metaStore := ns.Get(record.Namespace)
+	metaStore.mtx.Lock()
+	defer metaStore.mtx.Unlock()
+
+	if record.FileMeta != nil && record.Purged {
+		metaStore.applyPurge(record.FileMeta.Filename)
+	} else if record.FileMeta != nil {
+		metaStore.applyFileMeta(*record.FileMeta)
+	}
+	for _, fileMeta := range record.Batch {
+		metaStore.applyFileMeta(fileMeta)
+	}
+	if record.ACL != nil {
+		metaStore.applyACLEntry(*record.ACL)
+	}
+}
+
+// setJournal makes all namespaces write their changes to the journal.
+func (ns *NamespaceStore) setJournal(journal *Journal) {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+
+	ns.journal = journal
+	for _, metaStore := range ns.MetaStores {
+		metaStore.mtx.Lock()
+		metaStore.journal = journal
+		metaStore.mtx.Unlock()
+	}
+}
+
+func (ns *NamespaceStore) getJournalRecords() []JournalRecord {
+	var records []JournalRecord
+	for _, namespace := range ns.List() {
+		metaStore, _ := ns.Lookup(namespace)
+		records = append(records, metaStore.getJournalRecords()...)
+	}
+	return records
+}
+
+func (ns *NamespaceStore) List() []string {
+	ns.mtx.Lock()
+	defer ns.mtx.Unlock()
+
+	namespaces := make([]string, 0, len(ns.MetaStores))
+	for namespace := range ns.MetaStores {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+func validateNamespace(namespace string) error {
+	if len(namespace) > 64 || strings.ContainsAny(namespace, " ,/\\\n") {
+		return ErrInvalidNamespace
+	}
+	return nil
+}
+
+// Usage is the storage used by the files of one namespace. LogicalBytes counts
+// every block of every file, UniqueBytes counts each distinct block once.
+// PhysicalBytes counts the blocks first uploaded by the user of the session,
+// which are charged to the user no matter which namespace refers to them.
+// A quota of 0 means unlimited.
+type Usage struct {
+	Namespace     string
+	Files         int
+	Blocks        int
+	LogicalBytes  int64
+	LogicalQuota  int64
+	UniqueBytes   int64
+	PhysicalBytes int64
+	PhysicalQuota int64
+}
+
+func getUsage(namespace string, metaStore *MetaStore, blockStore BlockStorage) Usage {
+	fileMetaMap := make(map[string]FileMetaData)
+	_ = metaStore.GetFileInfoMap(nil, &fileMetaMap)
+
+	usage := Usage{Namespace: namespace}
+	usage.LogicalBytes, usage.LogicalQuota = metaStore.GetLogicalBytes()
+	seenBlocks := make(map[string]bool)
+	for _, fileMeta := range fileMetaMap {
+		if fileMeta.IsTombstone() {
+			continue
+		}
+		usage.Files++
+		for _, blockHash := range fileMeta.BlockHashList {
+			if !seenBlocks[blockHash] {
+				seenBlocks[blockHash] = true
+				blockSize, _ := blockStore.GetBlockSize(blockHash)
+				usage.Blocks++
+				usage.UniqueBytes += int64(blockSize)
+			}
+		}
+	}
+	return usage
+}
@@ -0,0 +1,189 @@
+package surfstore
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// IsQuotaExceeded reports whether the error returned by an RPC call is caused
+// by an exceeded quota. Errors lose their identity when sent over RPC, so the
+// message is compared instead.
+func IsQuotaExceeded(err error) bool {
+	return err != nil && err.Error() == ErrQuotaExceeded.Error()
+}
+
+// Quota holds the storage limits of a user, 0 means the server default.
+// PhysicalBytes limits the bytes of the blocks uploaded by the user,
+// LogicalBytes limits the size of all files in the namespace of the user.
+type Quota struct {
+	PhysicalBytes int64
+	LogicalBytes  int64
+}
+
+// UploadAccounting charges every stored block to the account that uploaded
+// it first. Blocks that are already stored are deduplicated and not charged
+// again.
+type UploadAccounting struct {
+	mtx         sync.Mutex
+	blockOwners map[string]string
+	bytes       map[string]int64
+	blockSizes  map[string]int
+	// charges are written to the journal when it is set
+	journal *Journal
+}
+
+func NewUploadAccounting() *UploadAccounting {
+	return &UploadAccounting{
+		blockOwners: map[string]string{},
+		bytes:       map[string]int64{},
+		blockSizes:  map[string]int{},
+	}
+}
+
+// Reserve charges the block to the account unless it was charged before. It
+// fails if the charge would exceed the quota of the account, 0 means
+// unlimited. The returned release function undoes the charge if the block
+// could not be stored.
+func (ua *UploadAccounting) Reserve(account string, blockHash string, blockSize int, quota int64) (release func(), err error) {
+	ua.mtx.Lock()
+	defer ua.mtx.Unlock()
+
+	if _, ok := ua.blockOwners[blockHash]; ok {
+		return func() {}, nil
+	}
+	if quota > 0 && ua.bytes[account]+int64(blockSize) > quota {
+		return nil, ErrQuotaExceeded
+	}
+
+	charge := BlockCharge{Account: account, BlockHash: blockHash, BlockSize: blockSize}
+	if ua.journal != nil {
+		err := ua.journal.Append(JournalRecord{Charge: &charge})
+		if err != nil {
+			return nil, err
+		}
+	}
+	ua.applyCharge(charge)
+
+	release = func() {
+		ua.mtx.Lock()
+		defer ua.mtx.Unlock()
+
+		if ua.blockOwners[blockHash] != account {
+			return
+		}
+		charge.Released = true
+		if ua.journal != nil {
+			_ = ua.journal.Append(JournalRecord{Charge: &charge})
+		}
+		ua.applyCharge(charge)
+	}
+	return release, nil
+}
+
+// applyCharge records the charge, or undoes it if it was released. The caller
+// must hold the lock.
+func (ua *UploadAccounting) applyCharge(charge BlockCharge) {
+	if charge.Released {
+		delete(ua.blockOwners, charge.BlockHash)
+		delete(ua.blockSizes, charge.BlockHash)
+		ua.bytes[charge.Account] -= int64(charge.BlockSize)
+		return
+	}
+	ua.blockOwners[charge.BlockHash] = charge.Account
+	ua.blockSizes[charge.BlockHash] = charge.BlockSize
+	ua.bytes[charge.Account] += int64(charge.BlockSize)
+}
+
+func (ua *UploadAccounting) applyJournalRecord(record JournalRecord) {
+	if record.Charge == nil {
+		return
+	}
+	ua.mtx.Lock()
+	defer ua.mtx.Unlock()
+
+	ua.applyCharge(*record.Charge)
+}
+
+func (ua *UploadAccounting) setJournal(journal *Journal) {
+	ua.mtx.Lock()
+	defer ua.mtx.Unlock()
+
+	ua.journal = journal
+}
+
+func (ua *UploadAccounting) getJournalRecords() []JournalRecord {
+	ua.mtx.Lock()
+	defer ua.mtx.Unlock()
+
+	records := make([]JournalRecord, 0, len(ua.blockOwners))
+	for blockHash, account := range ua.blockOwners {
+		charge := BlockCharge{Account: account, BlockHash: blockHash, BlockSize: ua.blockSizes[blockHash]}
+		records = append(records, JournalRecord{Charge: &charge})
+	}
+	return records
+}
+
+// ReleaseBlock undoes the charge of a deleted block, crediting its size to the
+// account that uploaded it.
+func (ua *UploadAccounting) ReleaseBlock(blockHash string) error {
+	ua.mtx.Lock()
+	defer ua.mtx.Unlock()
+
+	account, ok := ua.blockOwners[blockHash]
+	if !ok {
+		return nil
+	}
+	charge := BlockCharge{Account: account, BlockHash: blockHash, BlockSize: ua.blockSizes[blockHash], Released: true}
+	if ua.journal != nil {
+		err := ua.journal.Append(JournalRecord{Charge: &charge})
+		if err != nil {
+			return err
+		}
+	}
+	ua.applyCharge(charge)
+	return nil
+}
+
+func (ua *UploadAccounting) GetBytes(account string) int64 {
+	ua.mtx.Lock()
+	defer ua.mtx.Unlock()
+
+	return ua.bytes[account]
+}
+
+// ParseByteSize parses a size like "512", "64K", "10M" or "2G" into bytes.
+func ParseByteSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(s, "B")
+
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || value < 0 {
+		return 0, errors.New("invalid size " + strconv.Quote(size))
+	}
+	if value > math.MaxInt64/multiplier {
+		return 0, errors.New("size " + strconv.Quote(size) + " too large")
+	}
+	return value * multiplier, nil
+}
@@ -0,0 +1,176 @@
+package surfstore
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SyncSelection selects the folders of the server a base directory holds,
+// by path prefixes. Files outside of the selection are not downloaded, but
+// recorded in the index, so they are neither uploaded nor deleted on the
+// server because they are missing locally.
+//
+// A file is selected if the longest prefix it is below is included. With
+// includes, files below none of the prefixes are excluded, otherwise they are
+// included. An exclude wins over an include of the same prefix.
+type SyncSelection struct {
+	Include []string
+	Exclude []string
+}
+
+// CleanSelectionPrefix turns a folder into a prefix of a selection.
+func CleanSelectionPrefix(prefix string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.Trim(prefix, "/")), "/")
+}
+
+func (s SyncSelection) IsSelected(filename string) bool {
+	longest := -1
+	selected := len(s.Include) == 0
+	for _, prefix := range s.Include {
+		if hasPathPrefix(filename, prefix) && len(prefix) > longest {
+			longest = len(prefix)
+			selected = true
+		}
+	}
+	for _, prefix := range s.Exclude {
+		if hasPathPrefix(filename, prefix) && len(prefix) >= longest {
+			longest = len(prefix)
+			selected = false
+		}
+	}
+	return selected
+}
+
+// mayContainSelected reports whether the directory or a directory below it is
+// selected, so the local scan has to look into it.
+func (s SyncSelection) mayContainSelected(dir string) bool {
+	if s.IsSelected(dir) {
+		return true
+	}
+	for _, prefix := range s.Include {
+		if hasPathPrefix(prefix, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPathPrefix reports whether the file is the prefix or below it. The
+// empty prefix is the base directory.
+func hasPathPrefix(filename string, prefix string) bool {
+	return prefix == "" || filename == prefix || strings.HasPrefix(filename, prefix+"/")
+}
+
+// syncFilter decides which files a sync handles. Ignored files and refused
+// links are left out completely, files outside of the selection are only
+// recorded in the index.
+type syncFilter struct {
+	ignore    *IgnoreRules
+	selection SyncSelection
+	// safeLinks refuses to upload links pointing outside of the base
+	// directory, the ones found by the scan are added to refusedLinks
+	safeLinks    bool
+	refusedLinks map[string]bool
+}
+
+func newSyncFilter(client RPCClient) syncFilter {
+	return syncFilter{
+		ignore:       LoadIgnoreRules(client.BaseDir),
+		selection:    client.Selection,
+		safeLinks:    client.SafeLinks,
+		refusedLinks: map[string]bool{},
+	}
+}
+
+func (f syncFilter) isSynced(filename string) bool {
+	return f.selection.IsSelected(filename) && !f.ignore.IsIgnored(filename) && !f.refusedLinks[filename]
+}
+
+// refusesLocalLink reports whether the local file is a link that must not be
+// uploaded.
+func (f syncFilter) refusesLocalLink(fileMeta *FileMetaData) bool {
+	return f.safeLinks && fileMeta.IsSymlink() && !isLinkInsideBaseDir(fileMeta.Filename, fileMeta.LinkTarget)
+}
+
+// refusesRemoteLink reports whether the file on the server is a link that
+// must not be created. Links pointing outside of the base directory are
+// never created, whether safeLinks is set or not.
+func (f syncFilter) refusesRemoteLink(fileMeta *FileMetaData) bool {
+	return fileMeta.IsSymlink() && !isLinkInsideBaseDir(fileMeta.Filename, fileMeta.LinkTarget)
+}
+
+// isLinkInsideBaseDir reports whether the relative target of the link stays
+// inside of the base directory. Absolute targets are outside, as they differ
+// between clients.
+func isLinkInsideBaseDir(filename string, linkTarget string) bool {
+	if path.IsAbs(linkTarget) {
+		return false
+	}
+	target := path.Join(path.Dir(filename), linkTarget)
+	return target != ".." && !strings.HasPrefix(target, "../")
+}
+
+// applySelection records the files on the server outside of the selection in
+// the index without downloading them. The local copies of files excluded
+// since the last sync are removed, unless they were changed.
+func applySelection(client RPCClient, fileMetaMap map[string]*FileMetaData, remoteMap map[string]FileMetaData, filter syncFilter) {
+	for filename, fileMeta := range fileMetaMap {
+		if _, ok := remoteMap[filename]; !ok && fileMeta.excluded {
+			delete(fileMetaMap, filename)
+		}
+	}
+
+	for filename, remoteMeta := range remoteMap {
+		if filter.selection.IsSelected(filename) || filter.ignore.IsIgnored(filename) {
+			continue
+		}
+		indexMeta := fileMetaMap[filename]
+		if indexMeta != nil && !indexMeta.excluded && !indexMeta.IsTombstone() {
+			removed, err := removeUnchangedFile(client, indexMeta)
+			if err != nil {
+				client.log().Error("failed to remove excluded file", "file", filename, "error", err)
+				continue
+			}
+			if !removed {
+				client.log().Warn("excluded file has local changes, keeping it", "file", filename)
+				continue
+			}
+			client.log().Info("removed excluded file", "file", filename)
+		}
+		remoteMeta := remoteMeta
+		remoteMeta.excluded = true
+		fileMetaMap[filename] = &remoteMeta
+	}
+}
+
+// removeUnchangedFile removes the local copy of the file if it has the
+// content recorded in the index. A missing file counts as removed.
+func removeUnchangedFile(client RPCClient, indexMeta *FileMetaData) (bool, error) {
+	path, err := getLocalPath(client, indexMeta.Filename)
+	if err != nil {
+		return false, err
+	}
+	if indexMeta.IsSymlink() {
+		linkTarget, err := os.Readlink(path)
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		if err != nil || filepath.ToSlash(linkTarget) != indexMeta.LinkTarget {
+			return false, err
+		}
+		return true, os.Remove(path)
+	}
+	blockHashList, err := getFileBlockHashList(path, client.BlockSize)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !isSameContent(indexMeta, &FileMetaData{BlockHashList: blockHashList}) {
+		return false, nil
+	}
+	return true, os.Remove(path)
+}
@@ -0,0 +1,122 @@
+package surfstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The file below the client state directory caching the block hash lists of
+// the local files.
+const statCacheFilename = "statcache"
+
+// Files modified this shortly before a scan are not cached, as a later change
+// within the resolution of the file system timestamps would keep the same
+// modification time.
+const statCacheRacyWindow = 2 * time.Second
+
+// fileStat is the stat information telling whether a file changed. Inode and
+// ChangeTime are 0 on systems without them.
+type fileStat struct {
+	Size       int64
+	ModTime    int64
+	Inode      uint64 `json:",omitempty"`
+	ChangeTime int64  `json:",omitempty"`
+}
+
+func getFileStat(fileInfo os.FileInfo) fileStat {
+	inode, changeTime := getFileInodeAndChangeTime(fileInfo)
+	return fileStat{
+		Size:       fileInfo.Size(),
+		ModTime:    fileInfo.ModTime().UnixNano(),
+		Inode:      inode,
+		ChangeTime: changeTime,
+	}
+}
+
+// statCacheEntry holds the block hash list of a file with the stat
+// information it was computed for.
+type statCacheEntry struct {
+	fileStat
+	BlockHashList []string
+}
+
+// statCache keeps the block hash lists of the local files between syncs, so
+// the scan only reads the files whose size, modification time, inode or
+// change time differ from the last scan.
+type statCache struct {
+	BlockSize int
+	Files     map[string]statCacheEntry
+}
+
+func newStatCache(blockSize int) *statCache {
+	return &statCache{BlockSize: blockSize, Files: map[string]statCacheEntry{}}
+}
+
+func getStatCachePath(baseDir string) string {
+	return filepath.Join(baseDir, clientStateDir, statCacheFilename)
+}
+
+// loadStatCache reads the stat cache of the base directory. It is empty with
+// FullRescan, and when it is missing, unreadable or was computed for another
+// block size.
+func loadStatCache(client RPCClient) *statCache {
+	cache := newStatCache(client.BlockSize)
+	if client.FullRescan {
+		return cache
+	}
+	content, err := ioutil.ReadFile(getStatCachePath(client.BaseDir))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			client.log().Warn("failed to read stat cache", "error", err)
+		}
+		return cache
+	}
+	var loaded statCache
+	err = json.Unmarshal(content, &loaded)
+	if err != nil {
+		client.log().Warn("failed to parse stat cache", "error", err)
+		return cache
+	}
+	if loaded.BlockSize != client.BlockSize || loaded.Files == nil {
+		return cache
+	}
+	return &loaded
+}
+
+// getBlockHashList returns the cached block hash list of the file, nil if the
+// file changed since it was cached.
+func (c *statCache) getBlockHashList(filename string, fileInfo os.FileInfo) []string {
+	entry, ok := c.Files[filename]
+	if !ok || entry.fileStat != getFileStat(fileInfo) {
+		return nil
+	}
+	return entry.BlockHashList
+}
+
+func (c *statCache) add(filename string, fileInfo os.FileInfo, blockHashList []string, scanStart time.Time) {
+	if !fileInfo.ModTime().Before(scanStart.Add(-statCacheRacyWindow)) {
+		return
+	}
+	c.Files[filename] = statCacheEntry{getFileStat(fileInfo), blockHashList}
+}
+
+// save replaces the stat cache of the base directory.
+func (c *statCache) save(client RPCClient) error {
+	content, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(client.BaseDir, clientStateDir), 0755)
+	if err != nil {
+		return err
+	}
+	path := getStatCachePath(client.BaseDir)
+	err = ioutil.WriteFile(path+".tmp", content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,14 @@
+package surfstore
+
+import (
+	"os"
+	"syscall"
+)
+
+func getFileInodeAndChangeTime(fileInfo os.FileInfo) (uint64, int64) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(stat.Ino), stat.Ctim.Nano()
+}
@@ -0,0 +1,286 @@
+package surfstore
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+var ErrMissingBlocks = errors.New("file refers to missing blocks")
+
+// AdminSession is the RPC receiver of the admin calls, registered as "Admin"
+// next to the Session of every connection. The calls are only allowed for
+// admins, or for clients on the same host when authentication is disabled.
+type AdminSession struct {
+	session *Session
+}
+
+type AdminListArgs struct {
+	// Namespace defaults to the namespace of the session
+	Namespace string
+	// All lists the files of all namespaces
+	All            bool
+	IncludeDeleted bool
+}
+
+type AdminFileArgs struct {
+	Namespace string
+	Filename  string
+}
+
+type AdminFileEntry struct {
+	Namespace string
+	FileMeta  FileMetaData
+	Size      int64
+}
+
+type AdminFileInfo struct {
+	AdminFileEntry
+	// BlockSizes holds the size of each block of the list, -1 if it is missing
+	BlockSizes []int
+}
+
+type AdminStats struct {
+	Namespaces []Usage
+	// all blocks in the block store, and those no file refers to
+	Blocks             int
+	BlockBytes         int64
+	UnreferencedBlocks int
+	UnreferencedBytes  int64
+	LogicalBytes       int64
+	DedupRatio         float64
+	MetadataEntries    int
+}
+
+type GCArgs struct {
+	// GracePeriod protects the blocks stored recently, which clients may
+	// have put without having updated the file referring to them yet
+	GracePeriod time.Duration
+	DryRun      bool
+}
+
+type GCResult struct {
+	Blocks int
+	Bytes  int64
+}
+
+func (s *Session) isAdmin() bool {
+	if s.user != nil {
+		return s.user.Admin
+	}
+	host := getClientHost(s.remoteAddr)
+	ip := net.ParseIP(host)
+	return s.server.Auth == nil && (host == "localhost" || ip != nil && ip.IsLoopback())
+}
+
+// getMetaStore returns the store of the namespace, or of the namespace of
+// the session if none is given.
+func (a *AdminSession) getMetaStore(namespace string) (string, *MetaStore, error) {
+	if !a.session.isAdmin() {
+		return "", nil, ErrForbidden
+	}
+	if namespace == "" {
+		namespace = a.session.namespace
+	}
+	metaStore, ok := a.session.server.Namespaces.Lookup(namespace)
+	if !ok {
+		return "", nil, errors.New("namespace not found")
+	}
+	return namespace, metaStore, nil
+}
+
+func (a *AdminSession) ListFiles(args AdminListArgs, entries *[]AdminFileEntry) error {
+	namespaces := []string{args.Namespace}
+	if args.All {
+		if !a.session.isAdmin() {
+			return ErrForbidden
+		}
+		namespaces = a.session.server.Namespaces.List()
+	}
+
+	for _, namespace := range namespaces {
+		namespace, metaStore, err := a.getMetaStore(namespace)
+		if err != nil {
+			return err
+		}
+		fileMetaMap := make(map[string]FileMetaData)
+		_ = metaStore.GetFileInfoMap(nil, &fileMetaMap)
+		for _, fileMeta := range fileMetaMap {
+			if fileMeta.IsTombstone() && !args.IncludeDeleted {
+				continue
+			}
+			*entries = append(*entries, AdminFileEntry{
+				Namespace: namespace,
+				FileMeta:  fileMeta,
+				Size:      metaStore.getFileSizeOf(fileMeta.Filename),
+			})
+		}
+	}
+
+	sort.Slice(*entries, func(i, j int) bool {
+		if (*entries)[i].Namespace != (*entries)[j].Namespace {
+			return (*entries)[i].Namespace < (*entries)[j].Namespace
+		}
+		return (*entries)[i].FileMeta.Filename < (*entries)[j].FileMeta.Filename
+	})
+	return nil
+}
+
+func (a *AdminSession) ShowFile(args AdminFileArgs, info *AdminFileInfo) error {
+	namespace, metaStore, err := a.getMetaStore(args.Namespace)
+	if err != nil {
+		return err
+	}
+	fileMetaMap := make(map[string]FileMetaData)
+	_ = metaStore.GetFileInfoMap(nil, &fileMetaMap)
+	fileMeta, ok := fileMetaMap[args.Filename]
+	if !ok {
+		return errors.New("file not found")
+	}
+
+	info.Namespace = namespace
+	info.FileMeta = fileMeta
+	info.Size = metaStore.getFileSizeOf(fileMeta.Filename)
+	if !fileMeta.IsTombstone() {
+		for _, blockHash := range fileMeta.BlockHashList {
+			blockSize, ok := a.session.server.BlockStore.GetBlockSize(blockHash)
+			if !ok {
+				blockSize = -1
+			}
+			info.BlockSizes = append(info.BlockSizes, blockSize)
+		}
+	}
+	return nil
+}
+
+func (a *AdminSession) GetStats(_ignore bool, stats *AdminStats) error {
+	if !a.session.isAdmin() {
+		return ErrForbidden
+	}
+	server := a.session.server
+
+	referenced := make(map[string]bool)
+	for _, namespace := range server.Namespaces.List() {
+		metaStore, ok := server.Namespaces.Lookup(namespace)
+		if !ok {
+			continue
+		}
+		usage := getUsage(namespace, metaStore, server.BlockStore)
+		stats.Namespaces = append(stats.Namespaces, usage)
+		stats.LogicalBytes += usage.LogicalBytes
+		entries, _ := metaStore.GetStats()
+		stats.MetadataEntries += entries
+		metaStore.addBlockReferences(referenced)
+	}
+
+	blocks, err := server.BlockStore.ListBlocks()
+	if err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		stats.Blocks++
+		stats.BlockBytes += int64(block.Size)
+		if !referenced[block.Hash] {
+			stats.UnreferencedBlocks++
+			stats.UnreferencedBytes += int64(block.Size)
+		}
+	}
+	stats.DedupRatio = 1
+	if stats.BlockBytes > 0 {
+		stats.DedupRatio = float64(stats.LogicalBytes) / float64(stats.BlockBytes)
+	}
+	return nil
+}
+
+func (a *AdminSession) CollectGarbage(args GCArgs, result *GCResult) error {
+	if !a.session.isAdmin() {
+		return ErrForbidden
+	}
+	var err error
+	*result, err = a.session.server.CollectGarbage(args.GracePeriod, args.DryRun)
+	if err == nil {
+		a.session.log.Info("garbage collected", "blocks", result.Blocks, "bytes", result.Bytes, "dry_run", args.DryRun)
+	}
+	return err
+}
+
+// PurgeFile removes the file including its history, see MetaStore.PurgeFile.
+// Its blocks are deleted by the next garbage collection.
+func (a *AdminSession) PurgeFile(args AdminFileArgs, succ *bool) error {
+	_, metaStore, err := a.getMetaStore(args.Namespace)
+	if err != nil {
+		return err
+	}
+	*succ, err = metaStore.PurgeFile(args.Filename)
+	if err == nil && !*succ {
+		return errors.New("file not found")
+	}
+	if err == nil {
+		a.session.log.Info("file purged", "file", args.Filename)
+	}
+	return err
+}
+
+// CollectGarbage deletes the blocks no file of any namespace refers to and
+// that are older than the grace period, and credits them to the accounts
+// that uploaded them. The block counts of the metrics are reset to the blocks
+// listed, correcting blocks counted twice by concurrent uploads.
+func (s *Server) CollectGarbage(gracePeriod time.Duration, dryRun bool) (GCResult, error) {
+	// UpdateFile checks that the blocks of a file exist while holding the
+	// read lock, so no block is deleted while a file starts referring to it
+	s.Namespaces.gcMtx.Lock()
+	defer s.Namespaces.gcMtx.Unlock()
+
+	var result GCResult
+	referenced := make(map[string]bool)
+	for _, namespace := range s.Namespaces.List() {
+		if metaStore, ok := s.Namespaces.Lookup(namespace); ok {
+			metaStore.addBlockReferences(referenced)
+		}
+	}
+
+	blocks, err := s.BlockStore.ListBlocks()
+	if err != nil {
+		return result, err
+	}
+	s.Metrics.setBlocks(blocks)
+	cutoff := time.Now().Add(-gracePeriod)
+	for _, block := range blocks {
+		if referenced[block.Hash] || block.StoredAt.After(cutoff) {
+			continue
+		}
+		if !dryRun {
+			err = s.BlockStore.DeleteBlock(block.Hash)
+			if err == nil {
+				s.Metrics.removeBlock(block.Size)
+				err = s.Accounting.ReleaseBlock(block.Hash)
+			}
+			if err != nil {
+				return result, err
+			}
+			for _, namespace := range s.Namespaces.List() {
+				if metaStore, ok := s.Namespaces.Lookup(namespace); ok {
+					metaStore.removeStoredBlock(block.Hash)
+				}
+			}
+		}
+		result.Blocks++
+		result.Bytes += int64(block.Size)
+	}
+	return result, nil
+}
+
+// checkBlocksExist fails if a block of the file is not stored, or if canUse
+// rejects it. The caller must hold the read lock of Namespaces.gcMtx.
+func (s *Server) checkBlocksExist(fileMeta *FileMetaData, canUse func(blockHash string) bool) error {
+	if fileMeta.IsTombstone() {
+		return nil
+	}
+	for _, blockHash := range fileMeta.BlockHashList {
+		if _, ok := s.BlockStore.GetBlockSize(blockHash); !ok || !canUse(blockHash) {
+			return ErrMissingBlocks
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package surfstore
+
+// The admin calls of the RPCClient, they need an admin token, or a server
+// without authentication on the same host.
+
+func (surfClient *RPCClient) callAdmin(method string, args interface{}, reply interface{}) error {
+	// connect to the server
+	conn, err := surfClient.dial()
+	if err != nil {
+		surfClient.log().Error("failed to connect to server", "rpc", "Admin."+method, "error", err)
+		return err
+	}
+	defer conn.Close()
+
+	// perform the RPC call
+	err = conn.Call("Admin."+method, args, reply)
+	if err != nil {
+		surfClient.log().Error("admin call failed", "rpc", "Admin."+method, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (surfClient *RPCClient) AdminListFiles(args AdminListArgs, entries *[]AdminFileEntry) error {
+	return surfClient.callAdmin("ListFiles", args, entries)
+}
+
+func (surfClient *RPCClient) AdminShowFile(args AdminFileArgs, info *AdminFileInfo) error {
+	return surfClient.callAdmin("ShowFile", args, info)
+}
+
+func (surfClient *RPCClient) AdminGetStats(stats *AdminStats) error {
+	return surfClient.callAdmin("GetStats", true, stats)
+}
+
+func (surfClient *RPCClient) AdminCollectGarbage(args GCArgs, result *GCResult) error {
+	return surfClient.callAdmin("CollectGarbage", args, result)
+}
+
+func (surfClient *RPCClient) AdminPurgeFile(args AdminFileArgs, succ *bool) error {
+	return surfClient.callAdmin("PurgeFile", args, succ)
+}
@@ -0,0 +1,190 @@
+package surfstore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The functions below work on single files on the server without syncing.
+// They do not change the base directory; the next sync downloads the
+// versions they create, as they are newer than those in the index.
+
+var ErrFileNotFound = errors.New("file not found")
+
+// ListRemoteFiles returns the files on the server below the folder prefix,
+// sorted by filename.
+func ListRemoteFiles(client RPCClient, prefix string, includeDeleted bool) ([]FileMetaData, error) {
+	dummyRPCParam := true
+	remoteMap := make(map[string]FileMetaData)
+	err := client.GetFileInfoMap(&dummyRPCParam, &remoteMap)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix = strings.Trim(prefix, "/")
+	var files []FileMetaData
+	for filename, fileMeta := range remoteMap {
+		if prefix != "" && filename != prefix && !strings.HasPrefix(filename, prefix+"/") {
+			continue
+		}
+		if fileMeta.IsTombstone() && !includeDeleted {
+			continue
+		}
+		files = append(files, fileMeta)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Filename < files[j].Filename })
+	return files, nil
+}
+
+// getRemoteFileVersion returns a version of the file kept by the server, the
+// current one if version is 0.
+func getRemoteFileVersion(client RPCClient, filename string, version int) (FileMetaData, error) {
+	var versions []FileMetaData
+	err := client.GetFileHistory(filename, &versions)
+	if err != nil {
+		return FileMetaData{}, err
+	}
+	if version == 0 {
+		return versions[len(versions)-1], nil
+	}
+	for _, fileMeta := range versions {
+		if fileMeta.Version == version {
+			return fileMeta, nil
+		}
+	}
+	return FileMetaData{}, errors.New("version not found")
+}
+
+// GetFile writes a version of the file on the server to w, the current one
+// if version is 0.
+func GetFile(client RPCClient, filename string, version int, w io.Writer) error {
+	fileMeta, err := getRemoteFileVersion(client, filename, version)
+	if err != nil {
+		return err
+	}
+	if fileMeta.IsTombstone() {
+		return ErrFileNotFound
+	}
+	if fileMeta.IsSymlink() {
+		return errors.New("file is a symbolic link to " + fileMeta.LinkTarget)
+	}
+
+	for _, blockHash := range fileMeta.BlockHashList {
+		var block Block
+		err := client.GetBlock(blockHash, &block)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(block.BlockData)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutFile uploads the file at localPath as a new version of the file on the
+// server.
+func PutFile(client RPCClient, localPath string, filename string) (FileMetaData, error) {
+	filename, err := cleanRemoteFilename(filename)
+	if err != nil {
+		return FileMetaData{}, err
+	}
+	fileInfo, err := os.Stat(localPath)
+	if err != nil {
+		return FileMetaData{}, err
+	}
+	blockHashList, err := getFileBlockHashList(localPath, client.BlockSize)
+	if err != nil {
+		return FileMetaData{}, err
+	}
+	err = putFileBlocks(client, localPath)
+	if err != nil {
+		return FileMetaData{}, err
+	}
+	return updateRemoteFile(client, FileMetaData{
+		Filename:      filename,
+		BlockHashList: blockHashList,
+		Mode:          uint32(fileInfo.Mode().Perm()),
+		ModTime:       fileInfo.ModTime().UnixNano(),
+	})
+}
+
+// RemoveRemoteFile deletes the file on the server, leaving a tombstone.
+func RemoveRemoteFile(client RPCClient, filename string) (FileMetaData, error) {
+	fileMeta, err := getRemoteFileVersion(client, filename, 0)
+	if err != nil {
+		return FileMetaData{}, err
+	}
+	if fileMeta.IsTombstone() {
+		return FileMetaData{}, ErrFileNotFound
+	}
+	tombstone := FileMetaData{Filename: filename}
+	tombstone.MarkTombstone()
+	return updateRemoteFile(client, tombstone)
+}
+
+// RestoreFile makes a previous version of the file the current one, as a new
+// version with its content and mode.
+func RestoreFile(client RPCClient, filename string, version int) (FileMetaData, error) {
+	fileMeta, err := getRemoteFileVersion(client, filename, version)
+	if err != nil {
+		return FileMetaData{}, err
+	}
+	if fileMeta.IsTombstone() {
+		return FileMetaData{}, errors.New("version is a deletion")
+	}
+	fileMeta.RenamedFrom = ""
+	return updateRemoteFile(client, fileMeta)
+}
+
+// updateRemoteFile stores the file as the version following the current one
+// on the server.
+func updateRemoteFile(client RPCClient, fileMeta FileMetaData) (FileMetaData, error) {
+	dummyRPCParam := true
+	remoteMap := make(map[string]FileMetaData)
+	err := client.GetFileInfoMap(&dummyRPCParam, &remoteMap)
+	if err != nil {
+		return FileMetaData{}, err
+	}
+
+	// the ID is saved, so the versions of all commands of the base directory
+	// count as changes of the same client, which is not the one of its syncs
+	clientID := client.ClientID
+	if clientID == "" {
+		clientID, err = loadClientID(client.BaseDir)
+		if err != nil {
+			return FileMetaData{}, fmt.Errorf("failed to save client ID: %v", err)
+		}
+	}
+	fileMeta.Version = remoteMap[fileMeta.Filename].Version + 1
+	fileMeta.BaseVersion = remoteMap[fileMeta.Filename].Version
+	fileMeta.HasBaseVersion = true
+	fileMeta.Vector = remoteMap[fileMeta.Filename].Vector.Increment(commandClientID(clientID))
+	var result UpdateResult
+	err = client.UpdateFileV2(&fileMeta, &result)
+	if err != nil {
+		return FileMetaData{}, err
+	}
+	if !result.Accepted {
+		return FileMetaData{}, fmt.Errorf("file changed on server, version %d was uploaded first, try again",
+			result.Current.Version)
+	}
+	return result.Current, nil
+}
+
+// cleanRemoteFilename turns a path into the name of a file on the server, a
+// slash separated path without "." and ".." elements.
+func cleanRemoteFilename(filename string) (string, error) {
+	cleaned := path.Clean("/" + strings.Replace(filename, "\\", "/", -1))[1:]
+	if cleaned == "" || cleaned == "index.txt" || cleaned == clientStateDir ||
+		strings.HasPrefix(cleaned, clientStateDir+"/") || strings.Contains(filename, ",") {
+		return "", errors.New("invalid filename " + filename)
+	}
+	return cleaned, nil
+}
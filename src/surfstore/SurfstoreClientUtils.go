@@ -2,98 +2,238 @@ package surfstore
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 /*
 Implement the logic for a client syncing with the server here.
 */
 func ClientSync(client RPCClient) {
+	if client.RequestID == "" {
+		client.RequestID = NewRequestID()
+	}
+	client.log().Info("sync started", "base_dir", client.BaseDir, "server", client.ServerAddr)
+	if client.ClientID == "" {
+		clientID, err := loadClientID(client.BaseDir)
+		if err != nil {
+			client.log().Warn("failed to save client ID, using a new one for this sync", "error", err)
+		}
+		client.ClientID = clientID
+	}
+
 	// ================================== create a map for old index.txt===============================
 	fileMetaMap := readIndexFile(client)
+	indexMap := copyFileMetaMap(fileMetaMap)
 
 	// =============================create map for local dir======================
-	fileMetaMap = updateFileMetaMapWithLocalFiles(client, fileMetaMap)
+	filter := newSyncFilter(client)
+	fileMetaMap = updateFileMetaMapWithLocalFiles(client, fileMetaMap, filter)
 	// PrintMetaMap(fileMetaMap)
 
 	// ============================ Now idxMetaMap is updated; try to compare with server map ===============
 	dummyRPCParam := true
 
 	// the idea is : if cannot update then download
+	var remoteFileMetaMap map[string]FileMetaData
+	blockIndex := newLocalBlockIndex(client, fileMetaMap)
 	retryMax := 3
 	for i := 0; i < retryMax; i++ {
 		// get server map
-		remoteFileMetaMap := make(map[string]FileMetaData)
+		remoteFileMetaMap = make(map[string]FileMetaData)
 		err := client.GetFileInfoMap(&dummyRPCParam, &remoteFileMetaMap)
 		if err != nil {
-			log.Println("Failed to get remote file meta map", err)
+			client.log().Warn("failed to get remote file meta map", "attempt", i+1, "error", err)
 			continue
 		}
+		for filename := range remoteFileMetaMap {
+			if validateFilename(filename) != nil {
+				client.log().Warn("ignoring remote file with invalid name", "file", filename)
+				delete(remoteFileMetaMap, filename)
+			}
+		}
 
-		isUploadFailed := false
-
-		// working on existing files in server and local
-		for remoteFilename, remoteFileMeta := range remoteFileMetaMap {
-			// if server match local file
-			if localFileMeta, ok := fileMetaMap[remoteFilename]; ok {
-				// modify and upload newest file to server
-				if localFileMeta.Version > remoteFileMeta.Version {
-					isUploadFailed = isUploadFailed || !uploadFile(client, localFileMeta)
-				} else {
-					err := downloadFile(client, localFileMeta, &remoteFileMeta)
-					if err == nil {
-						*localFileMeta = remoteFileMeta
+		var uploads []*FileMetaData
+		plan := planSync(indexMap, fileMetaMap, remoteFileMetaMap, filter)
+		renamed := renameLocalFiles(client, plan, fileMetaMap, remoteFileMetaMap)
+		for _, entry := range plan.Entries {
+			if renamed[entry.Filename] {
+				continue
+			}
+			localFileMeta := fileMetaMap[entry.Filename]
+			switch entry.Action {
+			case ActionUpload, ActionDeleteRemote:
+				localFileMeta.BaseVersion = remoteFileMetaMap[entry.Filename].Version
+				localFileMeta.HasBaseVersion = true
+				uploads = append(uploads, localFileMeta)
+			default:
+				// download the newer version of the server, which also
+				// updates the index if the content is the same
+				remoteFileMeta := remoteFileMetaMap[entry.Filename]
+				if entry.Action == ActionConflict {
+					copyPath, err := saveConflictCopy(client, localFileMeta)
+					if err != nil {
+						client.log().Error("conflict, failed to keep the local changes, file not synced",
+							"file", entry.Filename, "error", err)
+						continue
 					}
+					client.log().Warn("conflict, local changes are replaced by the version of the server",
+						"file", entry.Filename, "version", remoteFileMeta.Version, "local_copy", copyPath)
 				}
-			} else {
-				err := downloadFile(client, nil, &remoteFileMeta)
+				err := downloadFile(client, localFileMeta, &remoteFileMeta, blockIndex)
 				if err == nil {
-					localFileMeta := remoteFileMeta
-					fileMetaMap[remoteFilename] = &localFileMeta
+					fileMetaMap[entry.Filename] = &remoteFileMeta
 				}
 			}
 		}
 
-		// working on files only on local -> upload
-		for localFilename, localFileMeta := range fileMetaMap {
-			if _, ok := remoteFileMetaMap[localFilename]; !ok {
-				isUploadFailed = isUploadFailed || !uploadFile(client, localFileMeta)
-			}
-		}
-
-		if !isUploadFailed {
+		// a conflict rejects all uploads, the next attempt downloads the
+		// files changed on the server and uploads the others again
+		if uploadFiles(client, uploads, remoteFileMetaMap) {
 			break
 		}
 	}
+	// the index keeps the version local changes that were not uploaded are
+	// based on, so the next sync finds them again and uploads them based on
+	// that version
+	for filename, fileMeta := range fileMetaMap {
+		indexMeta, ok := indexMap[filename]
+		if ok && fileMeta.Version == indexMeta.Version || fileMeta.Version == remoteFileMetaMap[filename].Version {
+			continue
+		}
+		if ok {
+			fileMetaMap[filename] = indexMeta
+		} else {
+			delete(fileMetaMap, filename)
+		}
+	}
+	for _, remoteFileMeta := range remoteFileMetaMap {
+		if filter.refusesRemoteLink(&remoteFileMeta) {
+			client.log().Warn("refusing link pointing outside of the base directory",
+				"file", remoteFileMeta.Filename, "target", remoteFileMeta.LinkTarget)
+		}
+	}
+	if remoteFileMetaMap != nil {
+		applySelection(client, fileMetaMap, remoteFileMetaMap, filter)
+	}
 	// ==================================Finally, Write into a index file=============================
 	writeIndexFile(client, fileMetaMap)
+	client.log().Info("sync finished", "base_dir", client.BaseDir)
 }
 
-func uploadFile(client RPCClient, fileMeta *FileMetaData) bool {
-	// divide into blocks
-	filename := fileMeta.Filename
+// uploadFiles puts the blocks of the files the server does not have yet and
+// then updates the files in one batch, so other clients see either all or
+// none of the changes. Files whose blocks fail to upload are left out, with
+// the other half of their rename. If the server refuses the batch, e.g. for
+// lack of access to or quota for one of the files, the files are updated
+// separately, keeping the halves of renames together. The versions uploaded
+// are recorded in the remote map. It returns whether every file was uploaded.
+func uploadFiles(client RPCClient, fileMetas []*FileMetaData, remoteMap map[string]FileMetaData) bool {
+	failed := make(map[string]bool)
+	for _, fileMeta := range fileMetas {
+		if !fileMeta.IsTombstone() && !fileMeta.IsSymlink() {
+			err := putFileBlocks(client, filepath.Join(client.BaseDir, filepath.FromSlash(fileMeta.Filename)))
+			if err != nil {
+				logUploadFailure(client, fileMeta.Filename, err)
+				failed[fileMeta.Filename] = true
+			}
+		}
+	}
+	var batch []FileMetaData
+	for _, fileMeta := range fileMetas {
+		if !failed[fileMeta.Filename] && !failed[fileMeta.RenamedFrom] && !failed[fileMeta.RenamedTo] {
+			batch = append(batch, *fileMeta)
+		}
+	}
+	uploaded := len(batch) == len(fileMetas)
+	if len(batch) == 0 {
+		return uploaded
+	}
 
-	if fileMeta.IsTombstone() {
-		var latestVersion int
-		err := client.UpdateFile(fileMeta, &latestVersion)
+	groups := groupRenames(batch)
+	accepted, err := updateFiles(client, batch, remoteMap)
+	if err == nil {
+		return uploaded && accepted
+	}
+	if len(groups) == 1 {
+		logUpdateFailure(client, batch, err)
+		return false
+	}
+	client.log().Warn("batch update failed, updating the files separately", "files", len(batch), "error", err)
+	for _, group := range groups {
+		accepted, err := updateFiles(client, group, remoteMap)
 		if err != nil {
-			return false
+			logUpdateFailure(client, group, err)
+		}
+		uploaded = uploaded && accepted
+	}
+	return uploaded
+}
+
+func logUpdateFailure(client RPCClient, fileMetas []FileMetaData, err error) {
+	for _, fileMeta := range fileMetas {
+		logUploadFailure(client, fileMeta.Filename, err)
+	}
+}
+
+// updateFiles updates the files of batch at once and records the versions
+// uploaded in the remote map. It returns whether the server accepted them.
+func updateFiles(client RPCClient, batch []FileMetaData, remoteMap map[string]FileMetaData) (bool, error) {
+	var result UpdateFilesResult
+	err := client.UpdateFiles(batch, &result)
+	if err != nil {
+		return false, err
+	}
+	if !result.Accepted {
+		for _, conflict := range result.Conflicts {
+			client.log().Info("upload conflict, file changed on server", "file", conflict.Filename,
+				"version", conflict.Version, "server_version", conflict.Current.Version)
+		}
+		return false, nil
+	}
+	for _, fileMeta := range batch {
+		remoteMap[fileMeta.Filename] = fileMeta
+		client.log().Info("uploaded file", "file", fileMeta.Filename, "version", fileMeta.Version,
+			"deleted", fileMeta.IsTombstone())
+	}
+	return true, nil
+}
+
+// groupRenames splits the files of batch into groups of one file, or of the
+// new file and the tombstone of a rename.
+func groupRenames(batch []FileMetaData) [][]FileMetaData {
+	var groups [][]FileMetaData
+	groupOf := make(map[string]int)
+	for _, fileMeta := range batch {
+		i, ok := groupOf[fileMeta.RenamedFrom]
+		if !ok {
+			i, ok = groupOf[fileMeta.RenamedTo]
 		}
-		return fileMeta.Version == latestVersion
+		if !ok {
+			i = len(groups)
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], fileMeta)
+		groupOf[fileMeta.Filename] = i
 	}
+	return groups
+}
 
-	file, err := os.Open(filepath.Join(client.BaseDir, filename))
+// putFileBlocks puts the blocks of the file at path the server does not have
+// yet.
+func putFileBlocks(client RPCClient, path string) error {
+	file, err := os.Open(path)
 	if err != nil {
-		log.Println("uploadFile: Failed to open file", filename, err)
-		return false
+		return err
 	}
+	defer file.Close()
 
 	blockSize := client.BlockSize
 	fileInfo, _ := file.Stat()
@@ -110,51 +250,54 @@ func uploadFile(client RPCClient, fileMeta *FileMetaData) bool {
 
 		succ := false
 		err := client.PutBlock(block, &succ)
-		if !succ || err != nil {
-			log.Println("uploadFile: Failed to put empty block to the server")
-			return false
+		if err == nil && !succ {
+			err = errors.New("block not stored")
 		}
-	} else {
-		for i := int64(0); i < numBlocks; i++ {
-			currentBlockOffset := i * int64(blockSize)
-			var currentBlockSize int
-			if blockSize < int(fileSize-currentBlockOffset) {
-				currentBlockSize = blockSize
-			} else {
-				currentBlockSize = int(fileSize - currentBlockOffset)
-			}
+		return err
+	}
 
-			block := NewBlock(currentBlockSize)
-			_, err := file.Read(block.BlockData)
-			if err != nil {
-				return false
-			}
-			// write block to server
-			// if there is error -> get block fail -> put block
-			// if the error is nil -> get block succ -> no need
+	for i := int64(0); i < numBlocks; i++ {
+		currentBlockOffset := i * int64(blockSize)
+		var currentBlockSize int
+		if blockSize < int(fileSize-currentBlockOffset) {
+			currentBlockSize = blockSize
+		} else {
+			currentBlockSize = int(fileSize - currentBlockOffset)
+		}
+
+		block := NewBlock(currentBlockSize)
+		_, err := file.Read(block.BlockData)
+		if err != nil {
+			return err
+		}
+		// write block to server
+		// if there is error -> get block fail -> put block
+		// if the error is nil -> get block succ -> no need
+		succ := false
+		err = client.HasBlock(block.Hash(), &succ)
+		if err != nil {
+			return err
+		}
+		if !succ {
 			succ := false
-			err = client.HasBlock(block.Hash(), &succ)
-			if err != nil {
-				return false
+			err := client.PutBlock(block, &succ)
+			if err == nil && !succ {
+				err = errors.New("block not stored")
 			}
-			if !succ {
-				succ := false
-				err := client.PutBlock(block, &succ)
-				if !succ || err != nil {
-					log.Println("uploadFile: Failed to put block to server")
-					return false
-				}
+			if err != nil {
+				return err
 			}
 		}
 	}
+	return nil
+}
 
-	latestVersion := -1
-	err = client.UpdateFile(fileMeta, &latestVersion)
-	if err != nil {
-		return false
+func logUploadFailure(client RPCClient, filename string, err error) {
+	if IsQuotaExceeded(err) {
+		client.log().Error("quota exceeded, failed to upload file", "file", filename)
+	} else {
+		client.log().Error("failed to upload file", "file", filename, "error", err)
 	}
-
-	return fileMeta.Version == latestVersion
 }
 
 func readIndexFile(client RPCClient) map[string]*FileMetaData {
@@ -162,17 +305,17 @@ func readIndexFile(client RPCClient) map[string]*FileMetaData {
 	indexFilename := filepath.Join(client.BaseDir, "index.txt")
 	indexFile, err := os.Open(indexFilename)
 
+	fileMetaMap := make(map[string]*FileMetaData)
+	if os.IsNotExist(err) {
+		// index.txt does not exist before the first sync, it is created by
+		// writeIndexFile
+		return fileMetaMap
+	}
 	if err != nil {
-		// index.txt does not exit
-		indexFile, err = os.Create(indexFilename)
-		if err != nil {
-			panic(err)
-		}
+		panic(err)
 	}
 	defer indexFile.Close()
 
-	fileMetaMap := make(map[string]*FileMetaData)
-
 	// read index file
 	reader := bufio.NewReader(indexFile)
 	isReaderEnded := false
@@ -188,17 +331,28 @@ func readIndexFile(client RPCClient) map[string]*FileMetaData {
 
 		text := strings.TrimSuffix(line, "\n")
 		lineParts := strings.Split(text, ",")
-		if len(lineParts) == 3 {
+		if len(lineParts) == 3 || len(lineParts) == 4 {
 			filename := lineParts[0]
 			version, _ := strconv.Atoi(lineParts[1])
 			blockHasheListString := lineParts[2]
-			blockHasheList := strings.Split(blockHasheListString, " ")
+			var blockHasheList []string
+			// links have no blocks
+			if blockHasheListString != "" {
+				blockHasheList = strings.Split(blockHasheListString, " ")
+			}
 
 			fileMeta := FileMetaData{
 				Filename:      filename,
 				Version:       version,
 				BlockHashList: blockHasheList,
 			}
+			if len(lineParts) == 4 {
+				setIndexAttributes(&fileMeta, lineParts[3])
+			}
+			if validateFilename(filename) != nil {
+				client.log().Warn("ignoring index entry with invalid name", "file", filename)
+				continue
+			}
 			fileMetaMap[filename] = &fileMeta
 		} else {
 			panic("Invalid index.txt")
@@ -208,120 +362,353 @@ func readIndexFile(client RPCClient) map[string]*FileMetaData {
 	return fileMetaMap
 }
 
-func updateFileMetaMapWithLocalFiles(client RPCClient, fileMetaMap map[string]*FileMetaData) map[string]*FileMetaData {
-	localFileMap := getLocalFileHashBlockListMap(client)
+// The index has a fourth field with space separated key=value attributes for
+// the entries that need them, e.g.
+//
+//	docs/a.txt,3,9f86d08... 60303ae...,mode=644 mtime=1614834427089000000
+//
+// Unknown attributes are ignored, so indexes of newer clients can be read.
+func setIndexAttributes(fileMeta *FileMetaData, attributes string) {
+	for _, attribute := range strings.Fields(attributes) {
+		keyValue := strings.SplitN(attribute, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		switch keyValue[0] {
+		case "excluded":
+			fileMeta.excluded = keyValue[1] == "true"
+		case "mode":
+			mode, _ := strconv.ParseUint(keyValue[1], 8, 32)
+			fileMeta.Mode = uint32(mode)
+		case "mtime":
+			fileMeta.ModTime, _ = strconv.ParseInt(keyValue[1], 10, 64)
+		case "link":
+			fileMeta.LinkTarget, _ = url.QueryUnescape(keyValue[1])
+		case "vector":
+			fileMeta.Vector, _ = ParseVersionVector(keyValue[1])
+		}
+	}
+}
+
+func getIndexAttributes(fileMeta *FileMetaData) string {
+	var attributes []string
+	if fileMeta.Mode != 0 {
+		attributes = append(attributes, "mode="+strconv.FormatUint(uint64(fileMeta.Mode), 8))
+	}
+	if fileMeta.ModTime != 0 {
+		attributes = append(attributes, "mtime="+strconv.FormatInt(fileMeta.ModTime, 10))
+	}
+	if fileMeta.IsSymlink() {
+		attributes = append(attributes, "link="+url.QueryEscape(fileMeta.LinkTarget))
+	}
+	if len(fileMeta.Vector) > 0 {
+		attributes = append(attributes, "vector="+fileMeta.Vector.String())
+	}
+	if fileMeta.excluded {
+		attributes = append(attributes, "excluded=true")
+	}
+	return strings.Join(attributes, " ")
+}
+
+// updateFileMetaMapWithLocalFiles updates the index with the changes of the
+// local files. The entries of ignored files and of files outside of the
+// selection are left as they are. Excluded entries of files selected again
+// are dropped, so the files are downloaded as if they were new.
+func updateFileMetaMapWithLocalFiles(client RPCClient, fileMetaMap map[string]*FileMetaData, filter syncFilter) map[string]*FileMetaData {
+	localFileMap := getLocalFileMetaMap(client, filter)
+	// the files deleted with their content and the files created since the
+	// last sync, to find renames
+	deletedFiles := make(map[string][]string)
+	var createdFiles []*FileMetaData
 
 	// iterate over the file meta map and see if old file exists
 	for filename, fileMeta := range fileMetaMap {
-		if localBlockHashList, ok := localFileMap[filename]; ok {
-			// find the existing file
-			if len(localBlockHashList) != len(fileMeta.BlockHashList) {
-				fileMeta.BlockHashList = localBlockHashList
-				fileMeta.Version++
-			} else {
-				isFileUpdated := false
-				for i, blockHash := range localBlockHashList {
-					if blockHash != fileMeta.BlockHashList[i] {
-						fileMeta.BlockHashList[i] = blockHash
-						isFileUpdated = true
-					}
-				}
-
-				if isFileUpdated {
-					fileMeta.Version++
+		if !filter.isSynced(filename) {
+			continue
+		}
+		if fileMeta.excluded {
+			delete(fileMetaMap, filename)
+			continue
+		}
+		if localFileMeta, ok := localFileMap[filename]; ok {
+			// find the existing file, a change of the content or of the
+			// mode is a new version, a change of the modification time only
+			// is recorded
+			if !isSameFile(fileMeta, localFileMeta) {
+				if fileMeta.IsTombstone() {
+					createdFiles = append(createdFiles, fileMeta)
 				}
+				fileMeta.Version++
+				fileMeta.Vector = fileMeta.Vector.Increment(client.ClientID)
+				fileMeta.RenamedFrom = ""
+				fileMeta.RenamedTo = ""
 			}
+			fileMeta.BlockHashList = localFileMeta.BlockHashList
+			fileMeta.Mode = localFileMeta.Mode
+			fileMeta.ModTime = localFileMeta.ModTime
+			fileMeta.LinkTarget = localFileMeta.LinkTarget
 		} else {
 			// file does not exist in dir, shoud be deleted
 			// if file is not mark as deleted in file meta, update it
 			if !fileMeta.IsTombstone() {
+				if !fileMeta.IsSymlink() {
+					deletedFiles[filename] = fileMeta.BlockHashList
+				}
 				fileMeta.MarkTombstone()
 				fileMeta.Version++
+				fileMeta.Vector = fileMeta.Vector.Increment(client.ClientID)
 			}
 		}
 	}
 
 	// iterate over the local files and create new files
-	for filename, localBlockHashList := range localFileMap {
+	for filename, localFileMeta := range localFileMap {
 		if _, ok := fileMetaMap[filename]; !ok {
-			fileMeta := FileMetaData{
-				Filename:      filename,
-				Version:       1,
-				BlockHashList: localBlockHashList,
-			}
-			fileMetaMap[filename] = &fileMeta
+			localFileMeta.Version = 1
+			localFileMeta.Vector = VersionVector{}.Increment(client.ClientID)
+			fileMetaMap[filename] = localFileMeta
+			createdFiles = append(createdFiles, localFileMeta)
 		}
 	}
 
+	detectRenames(fileMetaMap, deletedFiles, createdFiles)
 	return fileMetaMap
 }
 
-func getLocalFileHashBlockListMap(client RPCClient) map[string][]string {
-	// open directory
-	localFileInfos, err := ioutil.ReadDir(client.BaseDir)
-	if err != nil {
-		panic(err)
+// detectRenames records a deleted file and a created file with the same
+// content as a rename, so other clients move their copy instead of
+// downloading it again. Contents shared by several deleted or created files
+// are left unmatched.
+func detectRenames(fileMetaMap map[string]*FileMetaData, deletedFiles map[string][]string, createdFiles []*FileMetaData) {
+	deletedByContent := make(map[string][]string)
+	for filename, blockHashList := range deletedFiles {
+		content := strings.Join(blockHashList, " ")
+		deletedByContent[content] = append(deletedByContent[content], filename)
+	}
+	createdByContent := make(map[string][]*FileMetaData)
+	for _, fileMeta := range createdFiles {
+		if fileMeta.IsSymlink() {
+			continue
+		}
+		content := strings.Join(fileMeta.BlockHashList, " ")
+		createdByContent[content] = append(createdByContent[content], fileMeta)
 	}
 
-	localFileMap := make(map[string][]string)
-	// iterate over all the local files
-	for _, fileInfo := range localFileInfos {
-		if fileInfo.Name() == "index.txt" {
+	for content, created := range createdByContent {
+		deleted := deletedByContent[content]
+		if len(created) != 1 || len(deleted) != 1 {
+			continue
+		}
+		created[0].RenamedFrom = deleted[0]
+		fileMetaMap[deleted[0]].RenamedTo = created[0].Filename
+	}
+}
+
+// renameLocalFiles moves the local copies of files renamed on the server to
+// their new name instead of downloading them again. Only unchanged copies
+// are moved, to a name without a local file. It returns the old and new
+// names of the files moved, which need no further sync.
+func renameLocalFiles(client RPCClient, plan SyncPlan, fileMetaMap map[string]*FileMetaData, remoteMap map[string]FileMetaData) map[string]bool {
+	actions := make(map[string]SyncAction)
+	for _, entry := range plan.Entries {
+		actions[entry.Filename] = entry.Action
+	}
+
+	renamed := make(map[string]bool)
+	for _, entry := range plan.Entries {
+		remoteMeta := remoteMap[entry.Filename]
+		source := remoteMeta.RenamedFrom
+		if entry.Action != ActionDownload || source == "" || actions[source] != ActionDeleteLocal || renamed[source] {
+			continue
+		}
+		localMeta := fileMetaMap[entry.Filename]
+		remoteSourceMeta := remoteMap[source]
+		if localMeta != nil && !localMeta.IsTombstone() || remoteSourceMeta.RenamedTo != entry.Filename ||
+			!isSameContent(fileMetaMap[source], &remoteMeta) {
 			continue
 		}
-		// check if the file is modified
 
-		file, err := os.Open(filepath.Join(client.BaseDir, fileInfo.Name()))
+		path, err := getLocalPath(client, entry.Filename)
+		var sourcePath string
+		if err == nil {
+			sourcePath, err = getLocalPath(client, source)
+		}
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+		}
+		if err == nil {
+			err = os.Rename(sourcePath, path)
+		}
 		if err != nil {
-			panic(err)
+			client.log().Warn("failed to rename file, downloading it", "file", entry.Filename, "from", source,
+				"error", err)
+			continue
 		}
-
-		// divide into blocks
-		fileSize := fileInfo.Size()
-		blockSize := client.BlockSize
-		numBlocks := fileSize / int64(blockSize)
-		if fileSize%int64(blockSize) != 0 {
-			numBlocks++
+		err = setFileAttributes(client, &remoteMeta)
+		if err != nil {
+			client.log().Warn("failed to set the attributes of renamed file", "file", entry.Filename, "error", err)
 		}
+		client.log().Info("renamed file", "file", entry.Filename, "from", source, "version", remoteMeta.Version)
+		fileMetaMap[entry.Filename] = &remoteMeta
+		fileMetaMap[source] = &remoteSourceMeta
+		renamed[entry.Filename] = true
+		renamed[source] = true
+	}
+	return renamed
+}
 
-		var blockHashList []string
-		// for empty file
-		if numBlocks == 0 {
-			// write to hash
-			block := NewBlock(0)
-			blockHashList = append(blockHashList, block.Hash())
-		}
-
-		for i := int64(0); i < numBlocks; i++ {
-			currentBlockOffset := i * int64(blockSize)
-			var currentBlockSize int
-			if blockSize < int(fileSize-currentBlockOffset) {
-				currentBlockSize = blockSize
-			} else {
-				currentBlockSize = int(fileSize - currentBlockOffset)
-			}
+// getLocalFiles lists the regular files and symbolic links below the base
+// directory, except for
+// index.txt, the state of the client in .surfstore and the files the filter
+// leaves out. Files in sub directories are named by their slash separated
+// path relative to the base directory.
+func getLocalFiles(client RPCClient, filter syncFilter) map[string]os.FileInfo {
+	localFileInfos := make(map[string]os.FileInfo)
+	err := filepath.Walk(client.BaseDir, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.IsDir() && path == filepath.Join(client.BaseDir, clientStateDir) {
+			return filepath.SkipDir
+		}
 
-			block := NewBlock(currentBlockSize)
+		relPath, err := filepath.Rel(client.BaseDir, path)
+		if err != nil {
+			return err
+		}
+		filename := filepath.ToSlash(relPath)
+		if fileInfo.IsDir() && filename != "." &&
+			(filter.ignore.isIgnored(filename, true) || !filter.selection.mayContainSelected(filename)) {
+			return filepath.SkipDir
+		}
+		// symbolic links are not followed, but synced as links
+		if !fileInfo.Mode().IsRegular() && fileInfo.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		if filename == "index.txt" || !filter.isSynced(filename) {
+			return nil
+		}
+		if validateFilename(filename) != nil {
+			client.log().Warn("not syncing file with invalid name", "file", filename)
+			return nil
+		}
+		localFileInfos[filename] = fileInfo
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	return localFileInfos
+}
 
-			_, err := file.Read(block.BlockData)
+// getLocalFileMetaMap returns the block hash list, mode and modification time
+// of every local file, and the target of every link. The versions are left 0.
+// Only the files changed since the last scan are hashed again, unless the
+// client does a full rescan.
+func getLocalFileMetaMap(client RPCClient, filter syncFilter) map[string]*FileMetaData {
+	scanStart := time.Now()
+	localFileInfos := getLocalFiles(client, filter)
+	cache := loadStatCache(client)
+	newCache := newStatCache(client.BlockSize)
+
+	localFileMap := make(map[string]*FileMetaData)
+	// iterate over all the local files
+	for filename, fileInfo := range localFileInfos {
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			linkTarget, err := os.Readlink(filepath.Join(client.BaseDir, filepath.FromSlash(filename)))
 			if err != nil {
-				panic("Invalid file read")
+				panic(err)
 			}
-			blockHashList = append(blockHashList, block.Hash())
+			fileMeta := &FileMetaData{Filename: filename, LinkTarget: filepath.ToSlash(linkTarget)}
+			if filter.refusesLocalLink(fileMeta) {
+				client.log().Warn("refusing link pointing outside of the base directory", "file", filename,
+					"target", fileMeta.LinkTarget)
+				filter.refusedLinks[filename] = true
+				continue
+			}
+			localFileMap[filename] = fileMeta
+			continue
+		}
+		blockHashList := cache.getBlockHashList(filename, fileInfo)
+		if blockHashList == nil {
+			var err error
+			blockHashList, err = getFileBlockHashList(filepath.Join(client.BaseDir, filepath.FromSlash(filename)), client.BlockSize)
+			if err != nil {
+				panic(err)
+			}
+		}
+		newCache.add(filename, fileInfo, blockHashList, scanStart)
+		localFileMap[filename] = &FileMetaData{
+			Filename:      filename,
+			BlockHashList: blockHashList,
+			Mode:          uint32(fileInfo.Mode().Perm()),
+			ModTime:       fileInfo.ModTime().UnixNano(),
 		}
-		localFileMap[fileInfo.Name()] = blockHashList
 	}
 
+	err := newCache.save(client)
+	if err != nil {
+		client.log().Warn("failed to save stat cache", "error", err)
+	}
 	return localFileMap
 }
 
+// getFileBlockHashList divides the file at path into blocks and returns their
+// hashes. An empty file has the hash of the empty block.
+func getFileBlockHashList(path string, blockSize int) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// divide into blocks
+	fileSize := fileInfo.Size()
+	numBlocks := fileSize / int64(blockSize)
+	if fileSize%int64(blockSize) != 0 {
+		numBlocks++
+	}
+
+	var blockHashList []string
+	// for empty file
+	if numBlocks == 0 {
+		// write to hash
+		block := NewBlock(0)
+		blockHashList = append(blockHashList, block.Hash())
+	}
+
+	for i := int64(0); i < numBlocks; i++ {
+		currentBlockOffset := i * int64(blockSize)
+		var currentBlockSize int
+		if blockSize < int(fileSize-currentBlockOffset) {
+			currentBlockSize = blockSize
+		} else {
+			currentBlockSize = int(fileSize - currentBlockOffset)
+		}
+
+		block := NewBlock(currentBlockSize)
+
+		_, err := io.ReadFull(file, block.BlockData)
+		if err != nil {
+			return nil, errors.New("invalid file read")
+		}
+		blockHashList = append(blockHashList, block.Hash())
+	}
+	return blockHashList, nil
+}
+
 func writeIndexFile(client RPCClient, fileMetaMap map[string]*FileMetaData) {
 	// err := os.Truncate(filepath.Join(client.BaseDir, "index.txt"), 0)
 
-	file, err := os.OpenFile(filepath.Join(client.BaseDir, "index.txt"), os.O_RDWR|os.O_TRUNC, 0755)
+	file, err := os.OpenFile(filepath.Join(client.BaseDir, "index.txt"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		panic(err)
 	}
+	defer file.Close()
 
 	for _, fileMeta := range fileMetaMap {
 		line := fmt.Sprintf(
@@ -331,6 +718,9 @@ func writeIndexFile(client RPCClient, fileMetaMap map[string]*FileMetaData) {
 			strings.Join(fileMeta.BlockHashList, " "),
 		)
 		line = strings.TrimSpace(line)
+		if attributes := getIndexAttributes(fileMeta); attributes != "" {
+			line += "," + attributes
+		}
 
 		_, err := file.WriteString(line + "\n")
 		if err != nil {
@@ -343,109 +733,183 @@ func writeIndexFile(client RPCClient, fileMetaMap map[string]*FileMetaData) {
 	}
 }
 
-func downloadFile(client RPCClient, localFileMeta *FileMetaData, remoteFileMeta *FileMetaData) error {
+// downloadFile writes the version of the server to the local file, unless it
+// has the same content already.
+func downloadFile(client RPCClient, localFileMeta *FileMetaData, remoteFileMeta *FileMetaData, blockIndex localBlockIndex) error {
 	if remoteFileMeta == nil {
 		return nil
 	}
 
-	if localFileMeta != nil && len(localFileMeta.BlockHashList) == len(remoteFileMeta.BlockHashList) {
-		isHashListEqual := true
-		for i, hash := range localFileMeta.BlockHashList {
-			if hash != remoteFileMeta.BlockHashList[i] {
-				isHashListEqual = false
-				break
+	if localFileMeta != nil {
+		if isSameContent(localFileMeta, remoteFileMeta) {
+			// only the mode or the modification time may differ
+			if remoteFileMeta.IsTombstone() || localFileMeta.IsTombstone() ||
+				localFileMeta.Mode == remoteFileMeta.Mode && localFileMeta.ModTime == remoteFileMeta.ModTime {
+				return nil
 			}
-		}
-
-		if isHashListEqual {
-			return nil
+			return setFileAttributes(client, remoteFileMeta)
 		}
 	}
 
 	var fileBlocks []*Block
+	reusedBlocks := 0
 	if !remoteFileMeta.IsTombstone() {
-		// get block map for remote
+		// copy the blocks present in any local file, including the old
+		// version of this one, and get the others from the server
+		reader := blockIndex.newReader(client)
 		blockMap := make(map[string]*Block)
-		for _, hash := range remoteFileMeta.BlockHashList {
-			blockMap[hash] = nil
-		}
-
-		// update map with local blocks with existing files
-		if localFileMeta != nil && !localFileMeta.IsTombstone() {
-			var fileInfo os.FileInfo
-			file, err := os.Open(filepath.Join(client.BaseDir, localFileMeta.Filename))
-			if err == nil {
-				fileInfo, err = file.Stat()
-			}
-
-			if err == nil {
-				// successfully access local file
-
-				// divide into blocks
-				fileSize := fileInfo.Size()
-				blockSize := client.BlockSize
-
-				// for empty file
-				if len(localFileMeta.BlockHashList) == 0 {
-					// write to hash
-					localBlock := NewBlock(0)
-
-					blockHash := localBlock.Hash()
-					block, found := blockMap[blockHash]
-					if found && block == nil {
-						blockMap[blockHash] = &localBlock
-					}
-				}
-
-				for i, localBlockHash := range localFileMeta.BlockHashList {
-					block, found := blockMap[localBlockHash]
-					if found && block == nil {
-						currentBlockOffset := int64(i) * int64(blockSize)
-						var currentBlockSize int
-						if blockSize < int(fileSize-currentBlockOffset) {
-							currentBlockSize = blockSize
-						} else {
-							currentBlockSize = int(fileSize - currentBlockOffset)
-						}
-
-						localBlock := NewBlock(currentBlockSize)
-						readBlockSize, err := file.ReadAt(localBlock.BlockData, currentBlockOffset)
-						if readBlockSize != currentBlockSize || (err != nil && err != io.EOF) {
-							continue
-						}
-						blockMap[localBlockHash] = &localBlock
-					}
+		for _, blockHash := range remoteFileMeta.BlockHashList {
+			block := blockMap[blockHash]
+			if block == nil {
+				block = reader.readBlock(blockHash)
+				if block != nil {
+					reusedBlocks++
 				}
 			}
-		}
-
-		for _, blockHash := range remoteFileMeta.BlockHashList {
-			if blockMap[blockHash] != nil {
-				localBlock := blockMap[blockHash]
-				fileBlocks = append(fileBlocks, localBlock)
-			} else {
-				var block Block
-				err := client.GetBlock(blockHash, &block)
+			if block == nil {
+				block = &Block{}
+				err := client.GetBlock(blockHash, block)
 				if err != nil {
 					panic(err)
 				}
-				fileBlocks = append(fileBlocks, &block)
-				blockMap[blockHash] = &block
 			}
+			fileBlocks = append(fileBlocks, block)
+			blockMap[blockHash] = block
 		}
+		// the file may be one of those read from
+		reader.close()
+	}
+
+	err := writeFile(client, remoteFileMeta, &fileBlocks)
+	if err == nil {
+		blockIndex.addFile(client, remoteFileMeta)
+		client.log().Info("downloaded file", "file", remoteFileMeta.Filename, "version", remoteFileMeta.Version,
+			"deleted", remoteFileMeta.IsTombstone(), "reused_blocks", reusedBlocks)
+	}
+	return err
+}
+
+// getLocalPath returns the path of the local copy of a file, refusing
+// invalid filenames and parent directories that are symbolic links, which
+// could name a file outside of the base directory.
+func getLocalPath(client RPCClient, filename string) (string, error) {
+	err := validateFilename(filename)
+	if err != nil {
+		return "", err
 	}
 
-	return writeFile(client, remoteFileMeta, &fileBlocks)
+	dir := client.BaseDir
+	parents := strings.Split(filename, "/")
+	for _, parent := range parents[:len(parents)-1] {
+		dir = filepath.Join(dir, parent)
+		fileInfo, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			// the directories below are created by writeFile
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fileInfo.Mode()&os.ModeSymlink != 0 {
+			return "", errors.New("parent directory " + strconv.Quote(parent) + " is a symbolic link")
+		}
+	}
+	return filepath.Join(client.BaseDir, filepath.FromSlash(filename)), nil
+}
+
+// The directory in the client state directory keeping the local versions of
+// conflicting files.
+const conflictsDirname = "conflicts"
+
+// saveConflictCopy copies the local version of a file the server version
+// replaces to <name>.conflict-<client ID> in the conflicts directory, adding
+// a number if an earlier copy exists. Deletions and links have no content to
+// keep, their copy path is empty.
+func saveConflictCopy(client RPCClient, fileMeta *FileMetaData) (string, error) {
+	if fileMeta.IsTombstone() || fileMeta.IsSymlink() {
+		return "", nil
+	}
+	path, err := getLocalPath(client, fileMeta.Filename)
+	if err != nil {
+		return "", err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	fileInfo, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	copyPath := filepath.Join(client.BaseDir, clientStateDir, conflictsDirname,
+		filepath.FromSlash(fileMeta.Filename)+".conflict-"+client.ClientID)
+	err = os.MkdirAll(filepath.Dir(copyPath), 0755)
+	if err != nil {
+		return "", err
+	}
+	dst, err := os.OpenFile(copyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileInfo.Mode().Perm())
+	for i := 2; os.IsExist(err); i++ {
+		dst, err = os.OpenFile(copyPath+"-"+strconv.Itoa(i), os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileInfo.Mode().Perm())
+		if err == nil {
+			copyPath += "-" + strconv.Itoa(i)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return copyPath, err
 }
 
 func writeFile(client RPCClient, fileMeta *FileMetaData, blocks *[]*Block) error {
+	path, err := getLocalPath(client, fileMeta.Filename)
+	if err != nil {
+		client.log().Error("refusing to write file", "file", fileMeta.Filename, "error", err)
+		return err
+	}
 	if fileMeta.IsTombstone() {
-		return os.Remove(filepath.Join(client.BaseDir, fileMeta.Filename))
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		client.log().Error("failed to create directory", "file", fileMeta.Filename, "error", err)
+		return err
+	}
+
+	// replace a link instead of writing to its target
+	if fileInfo, err := os.Lstat(path); err == nil && fileInfo.Mode()&os.ModeSymlink != 0 || fileMeta.IsSymlink() {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			client.log().Error("failed to remove file", "file", fileMeta.Filename, "error", err)
+			return err
+		}
+	}
+	if fileMeta.IsSymlink() {
+		if !isLinkInsideBaseDir(fileMeta.Filename, fileMeta.LinkTarget) {
+			client.log().Error("refusing to create link pointing outside of the base directory",
+				"file", fileMeta.Filename, "target", fileMeta.LinkTarget)
+			return errors.New("link target outside of the base directory")
+		}
+		err = os.Symlink(filepath.FromSlash(fileMeta.LinkTarget), path)
+		if err != nil {
+			client.log().Error("failed to create link", "file", fileMeta.Filename, "error", err)
+		}
+		return err
 	}
 
-	file, err := os.Create(filepath.Join(client.BaseDir, fileMeta.Filename))
+	file, err := os.Create(path)
 	if err != nil {
-		log.Println("writeFile: Failed to open file:", fileMeta.Filename, err)
+		client.log().Error("failed to open file", "file", fileMeta.Filename, "error", err)
 		return err
 	}
 
@@ -453,11 +917,40 @@ func writeFile(client RPCClient, fileMeta *FileMetaData, blocks *[]*Block) error
 	for _, block := range *blocks {
 		_, err := file.Write(block.BlockData)
 		if err != nil {
-			log.Println("writeFile: Failed to write to file:", fileMeta.Filename, err)
+			client.log().Error("failed to write to file", "file", fileMeta.Filename, "error", err)
+			return err
+		}
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	return setFileAttributes(client, fileMeta)
+}
+
+// setFileAttributes restores the mode and modification time of the file, if
+// they are known.
+func setFileAttributes(client RPCClient, fileMeta *FileMetaData) error {
+	path, err := getLocalPath(client, fileMeta.Filename)
+	if err != nil {
+		return err
+	}
+	if fileMeta.Mode != 0 {
+		err = os.Chmod(path, os.FileMode(fileMeta.Mode).Perm())
+		if err != nil {
+			client.log().Error("failed to set file mode", "file", fileMeta.Filename, "error", err)
+			return err
+		}
+	}
+	if fileMeta.ModTime != 0 {
+		modTime := time.Unix(0, fileMeta.ModTime)
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			client.log().Error("failed to set modification time", "file", fileMeta.Filename, "error", err)
 			return err
 		}
 	}
-	return file.Sync()
+	return nil
 }
 
 /*
@@ -0,0 +1,108 @@
+package surfstore
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverCodec is the gob codec of net/rpc, which is not exported, extended to
+// record the method and the duration of every call in the metrics and log.
+type serverCodec struct {
+	rwc    io.ReadWriteCloser
+	decBuf *bufio.Reader
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+
+	metrics *Metrics
+	log     *Logger
+	mtx     sync.Mutex
+	// the calls in flight by sequence number
+	calls map[uint64]codecCall
+}
+
+type codecCall struct {
+	method string
+	start  time.Time
+}
+
+func newServerCodec(conn io.ReadWriteCloser, metrics *Metrics, log *Logger) *serverCodec {
+	buf := bufio.NewWriter(conn)
+	decBuf := bufio.NewReader(conn)
+	return &serverCodec{
+		rwc:     conn,
+		decBuf:  decBuf,
+		dec:     gob.NewDecoder(decBuf),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		metrics: metrics,
+		log:     log,
+		calls:   make(map[uint64]codecCall),
+	}
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if conn, ok := c.rwc.(*trackedConn); ok && c.decBuf.Buffered() == 0 {
+		conn.awaitCall()
+	}
+	err := c.dec.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	c.calls[r.Seq] = codecCall{method: r.ServiceMethod, start: time.Now()}
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	c.mtx.Lock()
+	call, ok := c.calls[r.Seq]
+	delete(c.calls, r.Seq)
+	c.mtx.Unlock()
+	if ok {
+		duration := time.Since(call.start)
+		c.metrics.observeRPC(call.method, duration, r.Error != "")
+		method := strings.TrimPrefix(call.method, "Server.")
+		if r.Error != "" {
+			c.log.Debug("rpc call failed", "rpc", method, "duration", duration, "error", r.Error)
+		} else {
+			c.log.Debug("rpc call", "rpc", method, "duration", duration)
+		}
+	}
+
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.log.Error("failed to encode rpc response", "error", err)
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.log.Error("failed to encode rpc response body", "error", err)
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *serverCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
@@ -3,8 +3,14 @@ package surfstore
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"path"
+	"strings"
+	"time"
 )
 
+var ErrInvalidFilename = errors.New("invalid filename")
+
 type Block struct {
 	BlockData []byte
 	BlockSize int
@@ -29,16 +35,111 @@ type FileMetaData struct {
 	Filename      string
 	Version       int
 	BlockHashList []string
+	// BaseVersion is the version on the server the new version is based on,
+	// 0 for a new file. If HasBaseVersion is set, the server only accepts the
+	// update if it still has this version, so edits based on an older version
+	// are not lost. Clients that do not send it are not checked.
+	BaseVersion    int  `json:",omitempty"`
+	HasBaseVersion bool `json:",omitempty"`
+	// Vector tells which changes of which clients the version includes, so
+	// concurrent changes can be told apart from sequential ones. It is empty
+	// for versions uploaded without one.
+	Vector VersionVector `json:",omitempty"`
+	// Mode holds the permission bits of the file and ModTime its
+	// modification time in nanoseconds since the epoch. Both are 0 if the
+	// client that uploaded the file did not send them.
+	Mode    uint32 `json:",omitempty"`
+	ModTime int64  `json:",omitempty"`
+	// LinkTarget is the slash separated target of a symbolic link, which
+	// has no blocks
+	LinkTarget string `json:",omitempty"`
+	// RenamedFrom names the deleted file a new version was moved from, and
+	// RenamedTo the file the tombstone of a moved file was moved to
+	RenamedFrom string `json:",omitempty"`
+	RenamedTo   string `json:",omitempty"`
+
+	// excluded marks the entries of the client index for files outside of
+	// the sync selection. It is not sent to the server.
+	excluded bool
+}
+
+// validateFilename checks that the filename is a clean slash separated path
+// relative to the base directory, so a file of the server cannot be written
+// outside of the base directory of a client, nor replace index.txt or the
+// state of the client. Commas and newlines would break the lines of
+// index.txt, and backslashes separate paths on Windows.
+func validateFilename(filename string) error {
+	switch {
+	case filename == "" || filename == "." || path.IsAbs(filename) || path.Clean(filename) != filename,
+		filename == ".." || strings.HasPrefix(filename, "../"),
+		strings.ContainsAny(filename, "\\,\n"),
+		filename == "index.txt",
+		filename == clientStateDir || strings.HasPrefix(filename, clientStateDir+"/"):
+		return ErrInvalidFilename
+	}
+	return nil
 }
 
 func (fm *FileMetaData) MarkTombstone() {
 	fm.BlockHashList = []string{"0"}
+	fm.Mode = 0
+	fm.ModTime = 0
+	fm.LinkTarget = ""
+	fm.RenamedFrom = ""
+	fm.RenamedTo = ""
+}
+
+func (fm *FileMetaData) IsSymlink() bool {
+	return fm.LinkTarget != ""
 }
 
 func (fm *FileMetaData) IsTombstone() bool {
 	return len(fm.BlockHashList) == 1 && fm.BlockHashList[0] == "0"
 }
 
+// hasSameMode reports whether the files have the same permission bits, which
+// is the case if the mode of either is unknown.
+func (fm *FileMetaData) hasSameMode(other *FileMetaData) bool {
+	return fm.Mode == 0 || other.Mode == 0 || fm.Mode == other.Mode
+}
+
+// RejectReason tells why the server rejected the new version of a file.
+type RejectReason string
+
+const (
+	RejectedSameVersion  RejectReason = "version already exists"
+	RejectedOlderVersion RejectReason = "trying to update an older version"
+	RejectedBaseVersion  RejectReason = "file changed since the base version"
+	// RejectedConcurrentVersion rejects a version whose vector does not
+	// include all changes of the version on the server
+	RejectedConcurrentVersion RejectReason = "concurrent change of the file"
+)
+
+// UpdateResult tells whether UpdateFileV2 stored the new version. Current is
+// the entry of the file on the server after the call, which is the new
+// version if it was accepted and the one the update conflicted with if not.
+type UpdateResult struct {
+	Accepted bool
+	Current  FileMetaData
+	Reason   RejectReason
+}
+
+// UpdateFilesResult tells whether UpdateFiles stored the batch. If it did
+// not, Conflicts lists the files whose version is not newer than the one on
+// the server.
+type UpdateFilesResult struct {
+	Accepted  bool
+	Conflicts []FileConflict
+}
+
+type FileConflict struct {
+	Filename string
+	Version  int
+	// Current is the entry of the file on the server
+	Current FileMetaData
+	Reason  RejectReason
+}
+
 type Surfstore interface {
 	MetaStoreInterface
 	BlockStoreInterface
@@ -50,6 +151,12 @@ type MetaStoreInterface interface {
 
 	// Update a file's fileinfo entry
 	UpdateFile(fileMetaData *FileMetaData, latestVersion *int) (err error)
+
+	// Update a file's fileinfo entry, telling why a version was rejected
+	UpdateFileV2(fileMetaData *FileMetaData, result *UpdateResult) (err error)
+
+	// Update the fileinfo entries of several files, all of them or none
+	UpdateFiles(fileMetaData []FileMetaData, result *UpdateFilesResult) (err error)
 }
 
 type BlockStoreInterface interface {
@@ -66,3 +173,23 @@ type BlockStoreInterface interface {
 	// Check if certain blocks are alredy present on the server
 	HasBlocks(blockHashesIn []string, blockHashesOut *[]string) error
 }
+
+// BlockStorage is the server side view of a block store
+type BlockStorage interface {
+	BlockStoreInterface
+
+	// Get the size of a block without reading its data
+	GetBlockSize(blockHash string) (size int, ok bool)
+
+	// List all blocks, used by the garbage collection
+	ListBlocks() ([]BlockInfo, error)
+
+	// Delete a block no file refers to
+	DeleteBlock(blockHash string) error
+}
+
+type BlockInfo struct {
+	Hash     string
+	Size     int
+	StoredAt time.Time
+}
@@ -1,21 +1,110 @@
 package surfstore
 
 import (
-	"log"
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
 	"net/rpc"
+	"strings"
 )
 
+// The status line the server replies with to a successful HTTP CONNECT, the
+// same one used by rpc.DialHTTP.
+const rpcConnected = "200 Connected to Go RPC"
+
 type RPCClient struct {
 	ServerAddr string
 	BaseDir    string
 	BlockSize  int
+
+	// Token is sent to the server to authenticate every call.
+	Token string
+	// Namespace selects the namespace to sync with, the server picks the
+	// default namespace of the user when it is empty.
+	Namespace string
+	// TLSConfig makes the client connect to the server over TLS when it is set.
+	TLSConfig *tls.Config
+	// RequestID is sent to the server with every call and added to the log
+	// entries on both sides. ClientSync sets a new one for every sync.
+	RequestID string
+	// Selection limits the files ClientSync downloads
+	Selection SyncSelection
+	// SafeLinks makes ClientSync refuse to upload symbolic links pointing
+	// outside of the base directory. Such links on the server are never
+	// created.
+	SafeLinks bool
+	// ClientID identifies the client in the version vectors of the files it
+	// changes. ClientSync loads it from the base directory if it is empty.
+	ClientID string
+	// FullRescan makes the local scan hash every file instead of reusing the
+	// block hash lists of the unchanged files from the stat cache
+	FullRescan bool
+}
+
+func (surfClient *RPCClient) log() *Logger {
+	if surfClient.RequestID == "" {
+		return logger
+	}
+	return logger.With("request_id", surfClient.RequestID)
+}
+
+// dial connects to the server the same way rpc.DialHTTP does, but also sends
+// the API token of the client with the CONNECT request and optionally uses TLS.
+func (surfClient *RPCClient) dial() (*rpc.Client, error) {
+	var conn net.Conn
+	var err error
+	if surfClient.TLSConfig != nil {
+		conn, err = tls.Dial("tcp", surfClient.ServerAddr, surfClient.TLSConfig)
+	} else {
+		conn, err = net.Dial("tcp", surfClient.ServerAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	request := "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\r\n"
+	if surfClient.Token != "" {
+		request += "Authorization: Bearer " + surfClient.Token + "\r\n"
+	}
+	if surfClient.RequestID != "" {
+		request += requestIDHeader + ": " + surfClient.RequestID + "\r\n"
+	}
+	if surfClient.Namespace != "" {
+		request += namespaceHeader + ": " + surfClient.Namespace + "\r\n"
+	}
+	_, err = io.WriteString(conn, request+"\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.Status != rpcConnected {
+		conn.Close()
+		switch resp.StatusCode {
+		case http.StatusUnauthorized:
+			return nil, ErrUnauthenticated
+		case http.StatusForbidden:
+			return nil, ErrForbidden
+		}
+		return nil, errors.New("unexpected HTTP response: " + strings.TrimSpace(resp.Status))
+	}
+
+	return rpc.NewClient(conn), nil
 }
 
 func (surfClient *RPCClient) GetBlock(blockHash string, block *Block) error {
 	// connect to the server
-	conn, err := rpc.DialHTTP("tcp", surfClient.ServerAddr)
+	conn, err := surfClient.dial()
 	if err != nil {
-		log.Println("Client::GetBlock - Failed to connect to server", err)
+		surfClient.log().Error("failed to connect to server", "rpc", "GetBlock", "error", err)
 		return err
 	}
 	defer conn.Close()
@@ -23,19 +112,19 @@ func (surfClient *RPCClient) GetBlock(blockHash string, block *Block) error {
 	// perform the RPC call
 	err = conn.Call("Server.GetBlock", blockHash, block)
 	if err != nil {
-		log.Println("Client::GetBlock - Failed to get block ", blockHash, err)
+		surfClient.log().Error("failed to get block", "block", blockHash, "error", err)
 		return err
 	}
 
-	// log.Println("Client::GetBlock - Block received", blockHash)
+	surfClient.log().Debug("block received", "block", blockHash)
 	return nil
 }
 
 func (surfClient *RPCClient) HasBlock(blockHash string, succ *bool) error {
 	// connect to the server
-	conn, err := rpc.DialHTTP("tcp", surfClient.ServerAddr)
+	conn, err := surfClient.dial()
 	if err != nil {
-		log.Println("Client::HasBlock - Failed to connect to server", err)
+		surfClient.log().Error("failed to connect to server", "rpc", "HasBlock", "error", err)
 		return err
 	}
 	defer conn.Close()
@@ -43,7 +132,7 @@ func (surfClient *RPCClient) HasBlock(blockHash string, succ *bool) error {
 	// perform the RPC call
 	err = conn.Call("Server.HasBlock", blockHash, succ)
 	if err != nil {
-		log.Println("Client::HasBlock - Failed to check if server has block", blockHash, err)
+		surfClient.log().Error("failed to check if server has block", "block", blockHash, "error", err)
 		return err
 	}
 
@@ -52,9 +141,9 @@ func (surfClient *RPCClient) HasBlock(blockHash string, succ *bool) error {
 
 func (surfClient *RPCClient) PutBlock(block Block, succ *bool) error {
 	// connect to the server
-	conn, err := rpc.DialHTTP("tcp", surfClient.ServerAddr)
+	conn, err := surfClient.dial()
 	if err != nil {
-		log.Println("Client::PutBlock - Failed to connect to server", err)
+		surfClient.log().Error("failed to connect to server", "rpc", "PutBlock", "error", err)
 		return err
 	}
 	defer conn.Close()
@@ -62,7 +151,7 @@ func (surfClient *RPCClient) PutBlock(block Block, succ *bool) error {
 	// perform the RPC call
 	err = conn.Call("Server.PutBlock", block, succ)
 	if err != nil {
-		log.Println("Client::PutBlock - Failed to put block", block.Hash(), err)
+		surfClient.log().Error("failed to put block", "block", block.Hash(), "error", err)
 		return err
 	}
 
@@ -71,9 +160,9 @@ func (surfClient *RPCClient) PutBlock(block Block, succ *bool) error {
 
 func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockHashesOut *[]string) error {
 	// connect to the server
-	conn, err := rpc.DialHTTP("tcp", surfClient.ServerAddr)
+	conn, err := surfClient.dial()
 	if err != nil {
-		log.Println("Client::HasBlocks - Failed to connect to server", err)
+		surfClient.log().Error("failed to connect to server", "rpc", "HasBlocks", "error", err)
 		return err
 	}
 	defer conn.Close()
@@ -81,7 +170,7 @@ func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockHashesOut *[
 	// perform the RPC call
 	err = conn.Call("Server.HasBlocks", blockHashesIn, blockHashesOut)
 	if err != nil {
-		log.Println("Client::HasBlocks - Failed to check if server has blocks", err)
+		surfClient.log().Error("failed to check if server has blocks", "error", err)
 		return err
 	}
 
@@ -90,9 +179,9 @@ func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockHashesOut *[
 
 func (surfClient *RPCClient) GetFileInfoMap(succ *bool, serverFileInfoMap *map[string]FileMetaData) error {
 	// connect to the server
-	conn, err := rpc.DialHTTP("tcp", surfClient.ServerAddr)
+	conn, err := surfClient.dial()
 	if err != nil {
-		log.Println("Client::GetFileInfoMap - Failed to connect to server", err)
+		surfClient.log().Error("failed to connect to server", "rpc", "GetFileInfoMap", "error", err)
 		return err
 	}
 	defer conn.Close()
@@ -100,7 +189,7 @@ func (surfClient *RPCClient) GetFileInfoMap(succ *bool, serverFileInfoMap *map[s
 	// perform the call
 	err = conn.Call("Server.GetFileInfoMap", succ, serverFileInfoMap)
 	if err != nil {
-		log.Println("Client::GetFileInfoMap - Failed to get file info map", err)
+		surfClient.log().Error("failed to get file info map", "error", err)
 		return err
 	}
 
@@ -109,9 +198,9 @@ func (surfClient *RPCClient) GetFileInfoMap(succ *bool, serverFileInfoMap *map[s
 
 func (surfClient *RPCClient) UpdateFile(fileMeta *FileMetaData, latestVersion *int) error {
 	// connect to the server
-	conn, err := rpc.DialHTTP("tcp", surfClient.ServerAddr)
+	conn, err := surfClient.dial()
 	if err != nil {
-		log.Println("Client::UpdateFile - Failed to connect to server", err)
+		surfClient.log().Error("failed to connect to server", "rpc", "UpdateFile", "error", err)
 		return err
 	}
 	defer conn.Close()
@@ -119,7 +208,7 @@ func (surfClient *RPCClient) UpdateFile(fileMeta *FileMetaData, latestVersion *i
 	// perform the call
 	err = conn.Call("Server.UpdateFile", fileMeta, latestVersion)
 	if err != nil {
-		log.Println("Client::UpdateFile - Failed to update file meta:", fileMeta.Filename, err)
+		surfClient.log().Error("failed to update file meta", "file", fileMeta.Filename, "error", err)
 		return err
 	}
 
@@ -127,6 +216,139 @@ func (surfClient *RPCClient) UpdateFile(fileMeta *FileMetaData, latestVersion *i
 	return nil
 }
 
+func (surfClient *RPCClient) UpdateFileV2(fileMeta *FileMetaData, result *UpdateResult) error {
+	conn, err := surfClient.dial()
+	if err != nil {
+		surfClient.log().Error("failed to connect to server", "rpc", "UpdateFileV2", "error", err)
+		return err
+	}
+	defer conn.Close()
+
+	// gob leaves out zero values, so a rejection must not find the result of
+	// an earlier call
+	*result = UpdateResult{}
+	err = conn.Call("Server.UpdateFileV2", fileMeta, result)
+	if err != nil {
+		surfClient.log().Error("failed to update file meta", "file", fileMeta.Filename, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (surfClient *RPCClient) UpdateFiles(fileMetas []FileMetaData, result *UpdateFilesResult) error {
+	conn, err := surfClient.dial()
+	if err != nil {
+		surfClient.log().Error("failed to connect to server", "rpc", "UpdateFiles", "error", err)
+		return err
+	}
+	defer conn.Close()
+
+	// gob leaves out zero values, so a rejection must not find the result of
+	// an earlier call
+	*result = UpdateFilesResult{}
+	err = conn.Call("Server.UpdateFiles", fileMetas, result)
+	if err != nil {
+		surfClient.log().Error("failed to update file metas", "files", len(fileMetas), "error", err)
+		return err
+	}
+	return nil
+}
+
+func (surfClient *RPCClient) GetUsage(succ *bool, usage *Usage) error {
+	// connect to the server
+	conn, err := surfClient.dial()
+	if err != nil {
+		surfClient.log().Error("failed to connect to server", "rpc", "GetUsage", "error", err)
+		return err
+	}
+	defer conn.Close()
+
+	// perform the call
+	err = conn.Call("Server.GetUsage", succ, usage)
+	if err != nil {
+		surfClient.log().Error("failed to get usage", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (surfClient *RPCClient) Share(entry ACLEntry, succ *bool) error {
+	// connect to the server
+	conn, err := surfClient.dial()
+	if err != nil {
+		surfClient.log().Error("failed to connect to server", "rpc", "Share", "error", err)
+		return err
+	}
+	defer conn.Close()
+
+	// perform the call
+	err = conn.Call("Server.Share", entry, succ)
+	if err != nil {
+		surfClient.log().Error("failed to share folder", "folder", entry.Folder, "error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (surfClient *RPCClient) Unshare(entry ACLEntry, succ *bool) error {
+	// connect to the server
+	conn, err := surfClient.dial()
+	if err != nil {
+		surfClient.log().Error("failed to connect to server", "rpc", "Unshare", "error", err)
+		return err
+	}
+	defer conn.Close()
+
+	// perform the call
+	err = conn.Call("Server.Unshare", entry, succ)
+	if err != nil {
+		surfClient.log().Error("failed to unshare folder", "folder", entry.Folder, "error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (surfClient *RPCClient) GetCollaborators(folder string, entries *[]ACLEntry) error {
+	// connect to the server
+	conn, err := surfClient.dial()
+	if err != nil {
+		surfClient.log().Error("failed to connect to server", "rpc", "GetCollaborators", "error", err)
+		return err
+	}
+	defer conn.Close()
+
+	// perform the call
+	err = conn.Call("Server.GetCollaborators", folder, entries)
+	if err != nil {
+		surfClient.log().Error("failed to get collaborators", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+func (surfClient *RPCClient) GetFileHistory(filename string, versions *[]FileMetaData) error {
+	// connect to the server
+	conn, err := surfClient.dial()
+	if err != nil {
+		surfClient.log().Error("failed to connect to server", "rpc", "GetFileHistory", "error", err)
+		return err
+	}
+	defer conn.Close()
+
+	// perform the call
+	err = conn.Call("Server.GetFileHistory", filename, versions)
+	if err != nil {
+		surfClient.log().Error("failed to get file history", "file", filename, "error", err)
+		return err
+	}
+
+	return nil
+}
+
 var _ Surfstore = new(RPCClient)
 
 // Create an Surfstore RPC client
@@ -1,85 +1,497 @@
 package surfstore
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// The HTTP header a client uses to select a namespace other than its default.
+const namespaceHeader = "X-Surfstore-Namespace"
+
+var ErrForbidden = errors.New("forbidden")
+
+// How long Shutdown waits for the calls in flight once it closed their
+// connections.
+const closeWait = time.Second
+
 type Server struct {
-	BlockStore BlockStoreInterface
-	MetaStore  MetaStoreInterface
+	BlockStore BlockStorage
+	Namespaces *NamespaceStore
+	Accounting *UploadAccounting
+
+	// DefaultQuota applies to users without a quota of their own and to
+	// every client when authentication is disabled.
+	DefaultQuota Quota
+
+	// Auth authenticates the clients. Authentication is disabled when it is nil.
+	Auth *AuthStore
+	// TLSConfig enables TLS for the connections from clients when it is set.
+	TLSConfig *tls.Config
+	// Journal persists the metadata of the disk backend.
+	Journal *Journal
+	// AuditLog records every file update when it is set.
+	AuditLog *AuditLog
+	// Metrics records the RPC calls, they are served at /metrics.
+	Metrics *Metrics
+
+	// MaxBlockSize limits the size of blocks put by clients, 0 means unlimited.
+	MaxBlockSize int64
+	// MaxConnections limits the number of concurrent client connections, 0
+	// means unlimited.
+	MaxConnections    int
+	activeConnections int64
+
+	// ShutdownTimeout limits how long ServeSurfstoreServer waits for the
+	// calls in flight when it is stopped by a signal.
+	ShutdownTimeout time.Duration
+
+	conns *connTracker
+}
+
+func NewSurfstoreServer() Server {
+	blockStore := BlockStore{BlockMap: map[string]Block{}}
+
+	return Server{
+		BlockStore: &blockStore,
+		Namespaces: NewNamespaceStore(&blockStore),
+		Accounting: NewUploadAccounting(),
+		Metrics:    NewMetrics(),
+		conns:      &connTracker{},
+	}
 }
 
-func (s *Server) GetFileInfoMap(succ *bool, serverFileInfoMap *map[string]FileMetaData) error {
-	err := s.MetaStore.GetFileInfoMap(succ, serverFileInfoMap)
+// ServeHTTP accepts the HTTP CONNECT request a client sends before speaking
+// RPC over the connection. The client is authenticated with the bearer token
+// in the Authorization header, and the connection is then served by an RPC
+// server bound to a Session of the client.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, _ = io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+
+	if s.conns.isDraining() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	numConnections := atomic.AddInt64(&s.activeConnections, 1)
+	defer atomic.AddInt64(&s.activeConnections, -1)
+	if s.MaxConnections > 0 && numConnections > int64(s.MaxConnections) {
+		logger.Warn("too many connections, connection rejected", "remote", req.RemoteAddr)
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return
+	}
+
+	session, err := s.newSession(req)
 	if err != nil {
-		*succ = false
+		logger.Warn("connection rejected", "remote", req.RemoteAddr, "error", err)
+		status := http.StatusUnauthorized
+		if err != ErrUnauthenticated {
+			status = http.StatusForbidden
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, err.Error()+"\n")
+		return
 	}
-	return err
+
+	rpcServer := rpc.NewServer()
+	err = rpcServer.RegisterName("Server", session)
+	if err == nil {
+		err = rpcServer.RegisterName("Admin", &AdminSession{session: session})
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	hijacked, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		session.log.Error("failed to hijack connection", "error", err)
+		return
+	}
+	conn := &trackedConn{Conn: hijacked}
+	if !s.conns.add(conn) {
+		conn.Close()
+		return
+	}
+	defer s.conns.remove(conn)
+	_, err = io.WriteString(conn, "HTTP/1.0 "+rpcConnected+"\n\n")
+	if err != nil {
+		conn.Close()
+		return
+	}
+	rpcServer.ServeCodec(newServerCodec(conn, s.Metrics, session.log))
 }
 
-func (s *Server) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) error {
-	err := s.MetaStore.UpdateFile(fileMetaData, latestVersion)
-	return err
+// newSession authenticates the client and resolves the namespace it works in.
+// Authenticated users work in the namespace named after them, they may only
+// select another one if they are admins or collaborators of the namespace.
+func (s *Server) newSession(req *http.Request) (*Session, error) {
+	namespace := req.Header.Get(namespaceHeader)
+	err := validateNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var user *User
+	if s.Auth != nil {
+		user, err = s.authenticate(req)
+		if err != nil {
+			return nil, err
+		}
+		if namespace == "" {
+			namespace = user.Name
+		} else if namespace != user.Name && !user.Admin && !s.isCollaborator(namespace, user.Name) {
+			return nil, ErrForbidden
+		}
+	}
+
+	metaStore := s.Namespaces.Get(namespace)
+	metaStore.SetQuota(s.getNamespaceQuota(namespace))
+
+	physicalQuota := s.DefaultQuota.PhysicalBytes
+	if user != nil && user.Quota.PhysicalBytes > 0 {
+		physicalQuota = user.Quota.PhysicalBytes
+	}
+
+	requestID := req.Header.Get(requestIDHeader)
+	if !isValidRequestID(requestID) {
+		requestID = NewRequestID()
+	}
+	sessionLog := logger.With("request_id", requestID, "remote", req.RemoteAddr, "namespace", namespace)
+	if user != nil {
+		sessionLog = sessionLog.With("user", user.Name)
+	}
+
+	return &Session{
+		server:        s,
+		user:          user,
+		namespace:     namespace,
+		metaStore:     metaStore,
+		physicalQuota: physicalQuota,
+		remoteAddr:    req.RemoteAddr,
+		requestID:     requestID,
+		log:           sessionLog,
+	}, nil
 }
 
-func (s *Server) GetBlock(blockHash string, blockData *Block) error {
-	err := s.BlockStore.GetBlock(blockHash, blockData)
-	return err
+// getNamespaceQuota returns the logical quota of the user owning the
+// namespace, or the default quota if there is no such user.
+func (s *Server) getNamespaceQuota(namespace string) int64 {
+	if s.Auth != nil {
+		owner, err := s.Auth.LookupUser(namespace)
+		if err == nil && owner.Quota.LogicalBytes > 0 {
+			return owner.Quota.LogicalBytes
+		}
+	}
+	return s.DefaultQuota.LogicalBytes
 }
 
-func (s *Server) PutBlock(blockData Block, succ *bool) error {
-	err := s.BlockStore.PutBlock(blockData, succ)
-	if err != nil {
-		*succ = false
+func (s *Server) isCollaborator(namespace string, username string) bool {
+	metaStore, ok := s.Namespaces.Lookup(namespace)
+	return ok && len(metaStore.GetUserACL(username)) > 0
+}
+
+// authenticate identifies the client by its API token, or by the common name
+// of its certificate when the connection uses mutual TLS.
+func (s *Server) authenticate(req *http.Request) (*User, error) {
+	authorization := req.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return s.Auth.Authenticate(strings.TrimPrefix(authorization, "Bearer "))
 	}
-	return err
+
+	// the certificates are only present when they were verified against
+	// the client CAs
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 && s.TLSConfig.ClientCAs != nil {
+		return s.Auth.LookupUser(req.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	return nil, ErrUnauthenticated
 }
 
-func (s *Server) HasBlock(blockHash string, succ *bool) error {
-	err := s.BlockStore.HasBlock(blockHash, succ)
-	return err
+// connTracker keeps the hijacked RPC connections, which the HTTP server no
+// longer knows about, so they can be drained on shutdown.
+type connTracker struct {
+	mtx      sync.Mutex
+	conns    map[*trackedConn]struct{}
+	draining bool
+	// closed when draining and the last connection is removed
+	drained chan struct{}
 }
 
-func (s *Server) HasBlocks(blockHashesIn []string, blockHashesOut *[]string) error {
-	err := s.BlockStore.HasBlocks(blockHashesIn, blockHashesOut)
-	return err
+func (t *connTracker) add(conn *trackedConn) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.draining {
+		return false
+	}
+	if t.conns == nil {
+		t.conns = make(map[*trackedConn]struct{})
+	}
+	t.conns[conn] = struct{}{}
+	return true
 }
 
-// This line guarantees all method for surfstore are implemented
-var _ Surfstore = new(Server)
+// remove is called once the connection is served, after the calls in flight
+// on it returned.
+func (t *connTracker) remove(conn *trackedConn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
 
-func NewSurfstoreServer() Server {
-	blockStore := BlockStore{BlockMap: map[string]Block{}}
-	metaStore := MetaStore{FileMetaMap: map[string]FileMetaData{}}
+	if _, ok := t.conns[conn]; !ok {
+		return
+	}
+	delete(t.conns, conn)
+	if t.draining && len(t.conns) == 0 {
+		close(t.drained)
+	}
+}
 
-	return Server{
-		BlockStore: &blockStore,
-		MetaStore:  &metaStore,
+func (t *connTracker) isDraining() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.draining
+}
+
+// drain stops reading new calls from the connections and returns a channel
+// closed once all of them are served. Calls that are already being received
+// or executed are answered before the connections are closed.
+func (t *connTracker) drain() <-chan struct{} {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if !t.draining {
+		t.draining = true
+		t.drained = make(chan struct{})
+		if len(t.conns) == 0 {
+			close(t.drained)
+		}
+		for conn := range t.conns {
+			conn.drain()
+		}
 	}
+	return t.drained
 }
 
-func ServeSurfstoreServer(hostAddr string, surfstoreServer Server) error {
-	err := rpc.Register(&surfstoreServer)
+func (t *connTracker) closeAll() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// trackedConn is a hijacked RPC connection that ends the stream of calls with
+// io.EOF once it is drained and no call is being received. The RPC server then
+// answers the calls in flight and closes the connection, so a call the client
+// is still sending, e.g. a large PutBlock, is not cut off.
+type trackedConn struct {
+	net.Conn
+
+	mtx sync.Mutex
+	// idle is set while waiting for the first byte of the next call
+	idle     bool
+	reading  bool
+	draining bool
+}
+
+// awaitCall is called by the codec when it starts reading the next call and
+// has no bytes of it buffered.
+func (c *trackedConn) awaitCall() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.idle = true
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	c.mtx.Lock()
+	if c.draining && c.idle {
+		c.mtx.Unlock()
+		return 0, io.EOF
+	}
+	c.reading = true
+	c.mtx.Unlock()
+
+	n, err := c.Conn.Read(p)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.reading = false
+	if n > 0 {
+		c.idle = false
+		if c.draining {
+			// drain may have interrupted the read just after the call arrived
+			_ = c.Conn.SetReadDeadline(time.Time{})
+		}
+		return n, err
+	}
+	if c.draining && c.idle {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// drain ends the stream of calls, interrupting the read of an idle connection.
+func (c *trackedConn) drain() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.draining = true
+	if c.idle && c.reading {
+		_ = c.Conn.SetReadDeadline(time.Now())
+	}
+}
+
+// ServerHandle controls a server started by StartSurfstoreServer.
+type ServerHandle struct {
+	server     *Server
+	httpServer *http.Server
+	listener   net.Listener
+
+	done     chan struct{}
+	serveErr error
+}
+
+// StartSurfstoreServer starts serving the clients in the background and
+// returns once the server listens on hostAddr.
+func StartSurfstoreServer(hostAddr string, surfstoreServer *Server) (*ServerHandle, error) {
+	if surfstoreServer.conns == nil {
+		surfstoreServer.conns = &connTracker{}
+	}
+	blocks, err := surfstoreServer.BlockStore.ListBlocks()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	rpc.HandleHTTP()
+	surfstoreServer.Metrics.setBlocks(blocks)
+
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, surfstoreServer)
+	mux.HandleFunc("/metrics", surfstoreServer.ServeMetrics)
+	mux.HandleFunc("/healthz", surfstoreServer.ServeHealthz)
+	mux.HandleFunc("/readyz", surfstoreServer.ServeReadyz)
+
 	ln, err := net.Listen("tcp", hostAddr)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if surfstoreServer.TLSConfig != nil {
+		ln = tls.NewListener(ln, surfstoreServer.TLSConfig)
 	}
 
+	handle := &ServerHandle{
+		server:     surfstoreServer,
+		httpServer: &http.Server{Handler: mux},
+		listener:   ln,
+		done:       make(chan struct{}),
+	}
 	go func() {
-		err := http.Serve(ln, nil)
-		if err != nil {
-			panic(err)
+		err := handle.httpServer.Serve(ln)
+		if err != http.ErrServerClosed {
+			handle.serveErr = err
 		}
+		close(handle.done)
 	}()
+	return handle, nil
+}
+
+func (h *ServerHandle) Addr() net.Addr {
+	return h.listener.Addr()
+}
+
+// Done is closed when the server stopped accepting connections, after
+// Shutdown or because the listener failed.
+func (h *ServerHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Err returns the error the server stopped with, if it was not shut down.
+func (h *ServerHandle) Err() error {
+	<-h.done
+	return h.serveErr
+}
 
-	fmt.Print("Press enter key to end server")
-	fmt.Scanln()
-	return nil
+// Shutdown stops accepting connections and waits until the calls in flight
+// are answered or ctx is done, in which case the remaining connections are
+// closed. The journal and the audit log are flushed and closed once every call
+// returned. Calls still running closeWait after the connections were closed,
+// e.g. a garbage collection, are left running and the journal and the audit
+// log stay open under them; Shutdown then returns the error of ctx.
+func (h *ServerHandle) Shutdown(ctx context.Context) error {
+	drained := h.server.conns.drain()
+	err := h.httpServer.Shutdown(ctx)
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		h.server.conns.closeAll()
+		if err == nil {
+			err = ctx.Err()
+		}
+		// the calls blocked on the closed connections return quickly
+		select {
+		case <-drained:
+		case <-time.After(closeWait):
+			return ctx.Err()
+		}
+	}
+
+	if h.server.Journal != nil {
+		if closeErr := h.server.Journal.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if h.server.AuditLog != nil {
+		if closeErr := h.server.AuditLog.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ServeSurfstoreServer serves the clients until the process receives SIGINT
+// or SIGTERM, and then shuts the server down gracefully.
+func ServeSurfstoreServer(hostAddr string, surfstoreServer Server) error {
+	handle, err := StartSurfstoreServer(hostAddr, &surfstoreServer)
+	if err != nil {
+		return err
+	}
+	logger.Info("listening", "addr", handle.Addr())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		logger.Info("shutting down", "signal", sig)
+	case <-handle.Done():
+		return handle.Err()
+	}
+
+	ctx := context.Background()
+	if surfstoreServer.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, surfstoreServer.ShutdownTimeout)
+		defer cancel()
+	}
+	return handle.Shutdown(ctx)
 }
@@ -0,0 +1,382 @@
+package surfstore
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrBlockTooLarge = errors.New("block too large")
+
+// Session is the RPC receiver of a single client connection. It binds every
+// call to the user the connection was authenticated as and to the namespace
+// the client works in.
+type Session struct {
+	server        *Server
+	user          *User
+	namespace     string
+	metaStore     *MetaStore
+	physicalQuota int64
+	remoteAddr    string
+	requestID     string
+	// log adds the request ID, client and namespace to the entries
+	log *Logger
+}
+
+// isOwner reports whether the session has full access to the namespace. This
+// is the case for the user owning the namespace, for admins, and for every
+// client when authentication is disabled.
+func (s *Session) isOwner() bool {
+	return s.user == nil || s.user.Admin || s.user.Name == s.namespace
+}
+
+// getAccessFilter returns a function reporting whether the session has at
+// least the given access to a file.
+func (s *Session) getAccessFilter(access Access) func(filename string) bool {
+	if s.isOwner() {
+		return func(string) bool { return true }
+	}
+	entries := s.metaStore.GetUserACL(s.user.Name)
+	return func(filename string) bool {
+		return getAccessFromACL(entries, filename) >= access
+	}
+}
+
+// getBlockFilter returns a function reporting whether the files of the
+// session may refer to a block. The block must have been put into the
+// namespace, by the user of the session unless it owns the namespace, so a
+// client cannot refer to the blocks of other tenants by their hashes.
+// Collaborators may also use the blocks of the files they can read.
+func (s *Session) getBlockFilter() func(blockHash string) bool {
+	if s.isOwner() {
+		return func(blockHash string) bool {
+			return s.metaStore.HasStoredBlock(blockHash, "")
+		}
+	}
+	canRead := s.getAccessFilter(AccessRead)
+	return func(blockHash string) bool {
+		return s.metaStore.HasStoredBlock(blockHash, s.getAccount()) ||
+			s.metaStore.HasBlockReferenceIn(blockHash, canRead)
+	}
+}
+
+func (s *Session) GetFileInfoMap(succ *bool, serverFileInfoMap *map[string]FileMetaData) error {
+	err := s.metaStore.GetFileInfoMap(succ, serverFileInfoMap)
+	if err != nil {
+		*succ = false
+		return err
+	}
+
+	if !s.isOwner() {
+		canRead := s.getAccessFilter(AccessRead)
+		for filename := range *serverFileInfoMap {
+			if !canRead(filename) {
+				delete(*serverFileInfoMap, filename)
+			}
+		}
+	}
+	return nil
+}
+
+// checkFilenames rejects the file if it or the file it was renamed from or to
+// has an invalid name, see validateFilename.
+func checkFilenames(fileMetaData *FileMetaData) error {
+	err := validateFilename(fileMetaData.Filename)
+	for _, filename := range []string{fileMetaData.RenamedFrom, fileMetaData.RenamedTo} {
+		if err == nil && filename != "" {
+			err = validateFilename(filename)
+		}
+	}
+	return err
+}
+
+// UpdateFile is UpdateFileV2 for clients that do not know it, see
+// MetaStore.UpdateFile.
+func (s *Session) UpdateFile(fileMetaData *FileMetaData, latestVersion *int) error {
+	var result UpdateResult
+	err := s.UpdateFileV2(fileMetaData, &result)
+	return toLatestVersion(fileMetaData, &result, latestVersion, err)
+}
+
+// UpdateFileV2 only accepts files with valid names, see checkFilenames, that
+// the session can write and whose blocks it may use, see getBlockFilter.
+func (s *Session) UpdateFileV2(fileMetaData *FileMetaData, result *UpdateResult) error {
+	err := checkFilenames(fileMetaData)
+	if err == nil && !s.getAccessFilter(AccessReadWrite)(fileMetaData.Filename) {
+		err = ErrForbidden
+	}
+	s.server.Namespaces.gcMtx.RLock()
+	if err == nil {
+		err = s.server.checkBlocksExist(fileMetaData, s.getBlockFilter())
+	}
+	if err == nil {
+		err = s.metaStore.updateFile(fileMetaData, result, s.auditUpdates)
+	} else {
+		// rejected before the metadata store audits it
+		_ = s.auditUpdates([]FileMetaData{*fileMetaData}, []int{0}, []string{err.Error()})
+	}
+	s.server.Namespaces.gcMtx.RUnlock()
+
+	if err != nil {
+		s.log.Warn("file update rejected", "file", fileMetaData.Filename,
+			"version", fileMetaData.Version, "error", err)
+	} else if !result.Accepted {
+		s.log.Info("file update rejected", "file", fileMetaData.Filename,
+			"version", fileMetaData.Version, "error", result.Reason)
+	} else {
+		s.log.Info("file updated", "file", fileMetaData.Filename, "version", fileMetaData.Version,
+			"blocks", len(fileMetaData.BlockHashList), "deleted", fileMetaData.IsTombstone())
+	}
+	return err
+}
+
+// UpdateFiles checks the name of, the access to and the blocks of every file
+// of the batch before storing it. Every file is audited separately.
+func (s *Session) UpdateFiles(fileMetas []FileMetaData, result *UpdateFilesResult) error {
+	var err error
+	// the file the batch is rejected for, if any
+	var failed string
+	canWrite := s.getAccessFilter(AccessReadWrite)
+	for i := range fileMetas {
+		err = checkFilenames(&fileMetas[i])
+		if err == nil && !canWrite(fileMetas[i].Filename) {
+			err = ErrForbidden
+		}
+		if err != nil {
+			failed = fileMetas[i].Filename
+			break
+		}
+	}
+	s.server.Namespaces.gcMtx.RLock()
+	canUseBlock := s.getBlockFilter()
+	for i := range fileMetas {
+		if err == nil {
+			err = s.server.checkBlocksExist(&fileMetas[i], canUseBlock)
+			if err != nil {
+				failed = fileMetas[i].Filename
+			}
+		}
+	}
+	if err == nil {
+		err = s.metaStore.updateFiles(fileMetas, result, s.auditUpdates)
+	} else {
+		// rejected before the metadata store audits it
+		reasons := make([]string, len(fileMetas))
+		for i := range reasons {
+			reasons[i] = err.Error()
+		}
+		_ = s.auditUpdates(fileMetas, make([]int, len(fileMetas)), reasons)
+	}
+	s.server.Namespaces.gcMtx.RUnlock()
+
+	if err != nil {
+		if failed != "" {
+			s.log.Warn("file batch update rejected", "files", len(fileMetas), "file", failed, "error", err)
+		} else {
+			s.log.Warn("file batch update rejected", "files", len(fileMetas), "error", err)
+		}
+	} else if !result.Accepted {
+		for _, conflict := range result.Conflicts {
+			s.log.Info("file update rejected", "file", conflict.Filename, "version", conflict.Version,
+				"error", conflict.Reason)
+		}
+	} else {
+		for _, fileMeta := range fileMetas {
+			s.log.Info("file updated", "file", fileMeta.Filename, "version", fileMeta.Version,
+				"blocks", len(fileMeta.BlockHashList), "deleted", fileMeta.IsTombstone(), "batch", len(fileMetas))
+		}
+	}
+	return err
+}
+
+// auditUpdates records updates of files in the audit log, see auditFunc.
+func (s *Session) auditUpdates(fileMetas []FileMetaData, oldVersions []int, reasons []string) error {
+	if s.server.AuditLog == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	entries := make([]AuditEntry, len(fileMetas))
+	for i, fileMeta := range fileMetas {
+		entries[i] = AuditEntry{
+			Time:       now,
+			User:       s.getUsername(),
+			Client:     getClientHost(s.remoteAddr),
+			Namespace:  s.namespace,
+			Filename:   fileMeta.Filename,
+			OldVersion: oldVersions[i],
+			NewVersion: fileMeta.Version,
+			Tombstone:  fileMeta.IsTombstone(),
+			Accepted:   reasons[i] == "",
+			Reason:     reasons[i],
+			RequestID:  s.requestID,
+		}
+	}
+	err := s.server.AuditLog.Append(entries...)
+	if err != nil {
+		s.log.Error("failed to write audit log", "files", len(fileMetas), "error", err)
+	}
+	return err
+}
+
+// GetFileHistory returns the versions the server keeps of a file, oldest
+// first and ending with the current version.
+func (s *Session) GetFileHistory(filename string, versions *[]FileMetaData) error {
+	if !s.getAccessFilter(AccessRead)(filename) {
+		return ErrForbidden
+	}
+	*versions = s.metaStore.GetFileHistory(filename)
+	if len(*versions) == 0 {
+		return errors.New("file not found")
+	}
+	return nil
+}
+
+func (s *Session) getUsername() string {
+	if s.user == nil {
+		return ""
+	}
+	return s.user.Name
+}
+
+// GetBlock only returns blocks referred to by a file the session can read, so
+// a client cannot read the blocks of other tenants by guessing their hashes.
+func (s *Session) GetBlock(blockHash string, blockData *Block) error {
+	if s.isOwner() {
+		if !s.metaStore.HasBlockReference(blockHash) {
+			return errors.New("block not found")
+		}
+	} else if !s.metaStore.HasBlockReferenceIn(blockHash, s.getAccessFilter(AccessRead)) {
+		return errors.New("block not found")
+	}
+	err := s.server.BlockStore.GetBlock(blockHash, blockData)
+	return err
+}
+
+// getAccount returns the account uploaded blocks are charged to. Without
+// authentication, the blocks are charged to the namespace.
+func (s *Session) getAccount() string {
+	if s.user == nil {
+		return s.namespace
+	}
+	return s.user.Name
+}
+
+func (s *Session) PutBlock(blockData Block, succ *bool) error {
+	if s.server.MaxBlockSize > 0 && int64(len(blockData.BlockData)) > s.server.MaxBlockSize {
+		*succ = false
+		return ErrBlockTooLarge
+	}
+
+	blockHash := blockData.Hash()
+	release, err := s.server.Accounting.Reserve(s.getAccount(), blockHash, len(blockData.BlockData), s.physicalQuota)
+	if err != nil {
+		*succ = false
+		return err
+	}
+
+	_, stored := s.server.BlockStore.GetBlockSize(blockHash)
+	err = s.server.BlockStore.PutBlock(blockData, succ)
+	if err != nil {
+		release()
+		*succ = false
+		return err
+	}
+	if !stored {
+		s.server.Metrics.addBlock(len(blockData.BlockData))
+	}
+	s.metaStore.addStoredBlock(blockHash, s.getAccount())
+	return nil
+}
+
+// HasBlock and HasBlocks only report the blocks the session may use, so a
+// client cannot probe for the content stored by other tenants.
+func (s *Session) HasBlock(blockHash string, succ *bool) error {
+	err := s.server.BlockStore.HasBlock(blockHash, succ)
+	if err == nil && *succ {
+		*succ = s.getBlockFilter()(blockHash)
+	}
+	return err
+}
+
+func (s *Session) HasBlocks(blockHashesIn []string, blockHashesOut *[]string) error {
+	var existingBlockHashes []string
+	err := s.server.BlockStore.HasBlocks(blockHashesIn, &existingBlockHashes)
+	if err != nil {
+		return err
+	}
+	canUseBlock := s.getBlockFilter()
+	for _, blockHash := range existingBlockHashes {
+		if canUseBlock(blockHash) {
+			*blockHashesOut = append(*blockHashesOut, blockHash)
+		}
+	}
+	return nil
+}
+
+// GetUsage reports the storage used by the namespace of the session and the
+// blocks uploaded by its user, together with their quotas.
+func (s *Session) GetUsage(_ignore *bool, usage *Usage) error {
+	*usage = getUsage(s.namespace, s.metaStore, s.server.BlockStore)
+	usage.PhysicalBytes = s.server.Accounting.GetBytes(s.getAccount())
+	usage.PhysicalQuota = s.physicalQuota
+	return nil
+}
+
+// Share grants a collaborator access to a folder of the namespace. Only the
+// owner of the namespace can share its folders.
+func (s *Session) Share(entry ACLEntry, succ *bool) error {
+	*succ = false
+	if s.user == nil {
+		return errors.New("sharing requires authentication")
+	}
+	if !s.isOwner() {
+		return ErrForbidden
+	}
+	if entry.Access != AccessRead && entry.Access != AccessReadWrite {
+		return errors.New("invalid access")
+	}
+	if entry.User == "" || entry.User == s.namespace {
+		return errors.New("invalid collaborator")
+	}
+
+	err := s.metaStore.SetAccess(entry.Folder, entry.User, entry.Access)
+	if err != nil {
+		return err
+	}
+	*succ = true
+	return nil
+}
+
+func (s *Session) Unshare(entry ACLEntry, succ *bool) error {
+	*succ = false
+	if s.user == nil {
+		return errors.New("sharing requires authentication")
+	}
+	if !s.isOwner() {
+		return ErrForbidden
+	}
+
+	removed, err := s.metaStore.RemoveAccess(entry.Folder, entry.User)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return errors.New("folder is not shared with the user")
+	}
+	*succ = true
+	return nil
+}
+
+// GetCollaborators lists the shared folders below the given folder together
+// with their collaborators. Collaborators only see their own entries.
+func (s *Session) GetCollaborators(folder string, entries *[]ACLEntry) error {
+	allEntries := s.metaStore.GetACL(folder)
+	for _, entry := range allEntries {
+		if s.isOwner() || entry.User == s.user.Name {
+			*entries = append(*entries, entry)
+		}
+	}
+	return nil
+}
+
+// This line guarantees all method for surfstore are implemented
+var _ Surfstore = new(Session)
@@ -0,0 +1,319 @@
+package surfstore
+
+import "sort"
+
+type SyncAction int
+
+const (
+	// ActionNone leaves the file as it is, the index may still take over
+	// the version of the server
+	ActionNone SyncAction = iota
+	ActionUpload
+	// ActionDeleteRemote uploads the tombstone of a file deleted locally
+	ActionDeleteRemote
+	ActionDownload
+	// ActionDeleteLocal removes a file deleted on the server
+	ActionDeleteLocal
+	// ActionConflict overwrites or removes a locally changed file with the
+	// version of the server, which wins as it was uploaded first. ClientSync
+	// keeps a copy of the local version, see saveConflictCopy.
+	ActionConflict
+)
+
+func (a SyncAction) String() string {
+	switch a {
+	case ActionUpload:
+		return "upload"
+	case ActionDeleteRemote:
+		return "delete remote"
+	case ActionDownload:
+		return "download"
+	case ActionDeleteLocal:
+		return "delete local"
+	case ActionConflict:
+		return "conflict"
+	default:
+		return "none"
+	}
+}
+
+type SyncPlanEntry struct {
+	Filename string
+	Action   SyncAction
+	// versions in the index, of the local file and on the server, 0 if the
+	// file is unknown there
+	IndexVersion  int
+	LocalVersion  int
+	RemoteVersion int
+}
+
+// SyncPlan lists what a sync does with each file, sorted by filename.
+type SyncPlan struct {
+	Entries []SyncPlanEntry
+}
+
+// Changes returns the entries of the files the sync changes.
+func (p SyncPlan) Changes() []SyncPlanEntry {
+	var changes []SyncPlanEntry
+	for _, entry := range p.Entries {
+		if entry.Action != ActionNone {
+			changes = append(changes, entry)
+		}
+	}
+	return changes
+}
+
+// planSync decides what to do with every file. The local file map holds the
+// index updated with the local changes. The server wins conflicts: a file is
+// only uploaded if its local version is newer than the one on the server, and
+// the local version of a conflicting file is kept as a copy by ClientSync.
+// Ignored files and files outside of the selection are left out of the plan.
+func planSync(indexMap, localMap map[string]*FileMetaData, remoteMap map[string]FileMetaData, filter syncFilter) SyncPlan {
+	var plan SyncPlan
+	addEntry := func(filename string, action SyncAction) {
+		entry := SyncPlanEntry{Filename: filename, Action: action}
+		if indexMeta, ok := indexMap[filename]; ok {
+			entry.IndexVersion = indexMeta.Version
+		}
+		if localMeta, ok := localMap[filename]; ok {
+			entry.LocalVersion = localMeta.Version
+		}
+		if remoteMeta, ok := remoteMap[filename]; ok {
+			entry.RemoteVersion = remoteMeta.Version
+		}
+		plan.Entries = append(plan.Entries, entry)
+	}
+
+	for filename, remoteMeta := range remoteMap {
+		remoteMeta := remoteMeta
+		if !filter.isSynced(filename) || filter.refusesRemoteLink(&remoteMeta) {
+			continue
+		}
+		localMeta, ok := localMap[filename]
+		if !ok {
+			if remoteMeta.IsTombstone() {
+				addEntry(filename, ActionNone)
+			} else {
+				addEntry(filename, ActionDownload)
+			}
+			continue
+		}
+		if order, ok := compareVersionVectors(localMeta, &remoteMeta); ok {
+			addEntry(filename, getVectorAction(localMeta, &remoteMeta, order))
+			continue
+		}
+
+		// without version vectors, the versions and the index tell which
+		// version is newer
+		switch {
+		case localMeta.Version > remoteMeta.Version && isBasedOn(indexMap[filename], &remoteMeta):
+			if localMeta.IsTombstone() {
+				addEntry(filename, ActionDeleteRemote)
+			} else {
+				addEntry(filename, ActionUpload)
+			}
+		case isSameFile(localMeta, &remoteMeta):
+			addEntry(filename, ActionNone)
+		case isLocallyChanged(indexMap[filename], localMeta):
+			addEntry(filename, ActionConflict)
+		case remoteMeta.IsTombstone():
+			addEntry(filename, ActionDeleteLocal)
+		default:
+			addEntry(filename, ActionDownload)
+		}
+	}
+
+	for filename, localMeta := range localMap {
+		if _, ok := remoteMap[filename]; ok || !filter.isSynced(filename) {
+			continue
+		}
+		if localMeta.IsTombstone() {
+			addEntry(filename, ActionDeleteRemote)
+		} else {
+			addEntry(filename, ActionUpload)
+		}
+	}
+
+	sort.Slice(plan.Entries, func(i, j int) bool {
+		return plan.Entries[i].Filename < plan.Entries[j].Filename
+	})
+	return plan
+}
+
+// getVectorAction decides what to do with a file whose local and remote
+// versions have version vectors. Concurrent changes are conflicts, unless
+// both made the same change. Equal vectors of different files are conflicts
+// too, as one of the changes was counted wrongly, and downloading the
+// version of the server would lose the local one.
+func getVectorAction(localMeta *FileMetaData, remoteMeta *FileMetaData, order VectorOrder) SyncAction {
+	switch {
+	case order == VectorDescendant && localMeta.IsTombstone():
+		return ActionDeleteRemote
+	case order == VectorDescendant:
+		return ActionUpload
+	case isSameFile(localMeta, remoteMeta):
+		return ActionNone
+	case order == VectorConcurrent || order == VectorEqual:
+		return ActionConflict
+	case remoteMeta.IsTombstone():
+		return ActionDeleteLocal
+	default:
+		return ActionDownload
+	}
+}
+
+// isSameFile reports whether the files have the same content and mode. The
+// modification times may differ.
+func isSameFile(fileMeta *FileMetaData, otherFileMeta *FileMetaData) bool {
+	return isSameContent(fileMeta, otherFileMeta) && fileMeta.hasSameMode(otherFileMeta)
+}
+
+// isSameContent compares the blocks of the files, or their targets if they
+// are symbolic links.
+func isSameContent(fileMeta *FileMetaData, otherFileMeta *FileMetaData) bool {
+	if fileMeta.LinkTarget != otherFileMeta.LinkTarget {
+		return false
+	}
+	if len(fileMeta.BlockHashList) != len(otherFileMeta.BlockHashList) {
+		return false
+	}
+	for i, blockHash := range fileMeta.BlockHashList {
+		if blockHash != otherFileMeta.BlockHashList[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isBasedOn reports whether the version on the server is the one in the
+// index, which the local changes are based on. Uploading changes based on
+// another version would replace a version the client has never seen, e.g.
+// after the server was restored from a backup.
+func isBasedOn(indexMeta *FileMetaData, remoteMeta *FileMetaData) bool {
+	return indexMeta != nil && indexMeta.Version == remoteMeta.Version
+}
+
+// isLocallyChanged reports whether the local file differs from the index.
+func isLocallyChanged(indexMeta *FileMetaData, localMeta *FileMetaData) bool {
+	if indexMeta == nil {
+		return !localMeta.IsTombstone()
+	}
+	return localMeta.Version != indexMeta.Version
+}
+
+// copyFileMetaMap returns a deep copy of the map, so updating the entries of
+// the copy does not change the original.
+func copyFileMetaMap(fileMetaMap map[string]*FileMetaData) map[string]*FileMetaData {
+	mapCopy := make(map[string]*FileMetaData, len(fileMetaMap))
+	for filename, fileMeta := range fileMetaMap {
+		fileMetaCopy := *fileMeta
+		fileMetaCopy.BlockHashList = append([]string(nil), fileMeta.BlockHashList...)
+		mapCopy[filename] = &fileMetaCopy
+	}
+	return mapCopy
+}
+
+// ComputeSyncPlan returns what ClientSync would do, without changing the
+// local files, the index or the server.
+func ComputeSyncPlan(client RPCClient) (SyncPlan, error) {
+	// local changes count as changes of the saved ID, as in the sync
+	if client.ClientID == "" {
+		client.ClientID, _ = readClientID(client.BaseDir)
+	}
+	indexMap := readIndexFile(client)
+	filter := newSyncFilter(client)
+	localMap := updateFileMetaMapWithLocalFiles(client, copyFileMetaMap(indexMap), filter)
+
+	dummyRPCParam := true
+	remoteMap := make(map[string]FileMetaData)
+	err := client.GetFileInfoMap(&dummyRPCParam, &remoteMap)
+	if err != nil {
+		return SyncPlan{}, err
+	}
+	return planSync(indexMap, localMap, remoteMap, filter), nil
+}
+
+// A FileChange is a change of a file since the last sync, "added",
+// "modified" or "deleted".
+type FileChange struct {
+	Filename string
+	Change   string
+	Version  int
+}
+
+// SyncStatus lists the changes of the local files and of the files on the
+// server since the last sync, as recorded in the index.
+type SyncStatus struct {
+	Local  []FileChange
+	Remote []FileChange
+}
+
+func GetSyncStatus(client RPCClient) (SyncStatus, error) {
+	if client.ClientID == "" {
+		client.ClientID, _ = readClientID(client.BaseDir)
+	}
+	indexMap := readIndexFile(client)
+	filter := newSyncFilter(client)
+	localMap := updateFileMetaMapWithLocalFiles(client, copyFileMetaMap(indexMap), filter)
+
+	dummyRPCParam := true
+	remoteMap := make(map[string]FileMetaData)
+	err := client.GetFileInfoMap(&dummyRPCParam, &remoteMap)
+	if err != nil {
+		return SyncStatus{}, err
+	}
+
+	var status SyncStatus
+	for filename, localMeta := range localMap {
+		if !filter.isSynced(filename) {
+			continue
+		}
+		if change := getFileChange(getSyncedIndexEntry(indexMap, filename), localMeta); change != "" {
+			status.Local = append(status.Local, FileChange{filename, change, localMeta.Version})
+		}
+	}
+	for filename, remoteMeta := range remoteMap {
+		remoteMeta := remoteMeta
+		indexMeta := getSyncedIndexEntry(indexMap, filename)
+		if !filter.isSynced(filename) || indexMeta != nil && remoteMeta.Version <= indexMeta.Version {
+			continue
+		}
+		if change := getFileChange(indexMeta, &remoteMeta); change != "" {
+			status.Remote = append(status.Remote, FileChange{filename, change, remoteMeta.Version})
+		}
+	}
+
+	for _, changes := range [][]FileChange{status.Local, status.Remote} {
+		changes := changes
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Filename < changes[j].Filename })
+	}
+	return status, nil
+}
+
+// getSyncedIndexEntry returns the entry of the file in the index, nil if the
+// file was not synced before or was outside of the selection.
+func getSyncedIndexEntry(indexMap map[string]*FileMetaData, filename string) *FileMetaData {
+	indexMeta := indexMap[filename]
+	if indexMeta != nil && indexMeta.excluded {
+		return nil
+	}
+	return indexMeta
+}
+
+// getFileChange compares a file with its entry in the index, which is nil
+// if the file was not synced before.
+func getFileChange(indexMeta *FileMetaData, fileMeta *FileMetaData) string {
+	switch {
+	case indexMeta == nil || indexMeta.IsTombstone():
+		if fileMeta.IsTombstone() {
+			return ""
+		}
+		return "added"
+	case fileMeta.IsTombstone():
+		return "deleted"
+	case !isSameFile(indexMeta, fileMeta):
+		return "modified"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,163 @@
+package surfstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The file below the client state directory holding the ID of the client in
+// the version vectors.
+const clientIDFilename = "client_id"
+
+// VersionVector counts the changes of a file made by each client, by client
+// ID. Unlike the version number, it tells whether a version includes the
+// changes of another one, or whether both were changed concurrently, e.g. by
+// clients that were offline for days.
+type VersionVector map[string]int
+
+type VectorOrder int
+
+const (
+	VectorEqual VectorOrder = iota
+	// VectorAncestor means the changes of the vector are all included in the
+	// other one
+	VectorAncestor
+	VectorDescendant
+	VectorConcurrent
+)
+
+func (o VectorOrder) String() string {
+	switch o {
+	case VectorEqual:
+		return "equal"
+	case VectorAncestor:
+		return "ancestor"
+	case VectorDescendant:
+		return "descendant"
+	default:
+		return "concurrent"
+	}
+}
+
+// Compare classifies the vector relative to the other one.
+func (v VersionVector) Compare(other VersionVector) VectorOrder {
+	isOlder, isNewer := false, false
+	for clientID, count := range v {
+		if count > other[clientID] {
+			isNewer = true
+		} else if count < other[clientID] {
+			isOlder = true
+		}
+	}
+	for clientID, count := range other {
+		if _, ok := v[clientID]; !ok && count > 0 {
+			isOlder = true
+		}
+	}
+
+	switch {
+	case isOlder && isNewer:
+		return VectorConcurrent
+	case isOlder:
+		return VectorAncestor
+	case isNewer:
+		return VectorDescendant
+	default:
+		return VectorEqual
+	}
+}
+
+// Increment returns a copy of the vector counting another change by the
+// client.
+func (v VersionVector) Increment(clientID string) VersionVector {
+	incremented := make(VersionVector, len(v)+1)
+	for id, count := range v {
+		incremented[id] = count
+	}
+	incremented[clientID]++
+	return incremented
+}
+
+// String formats the vector as "id:count" pairs separated by semicolons,
+// sorted by client ID.
+func (v VersionVector) String() string {
+	pairs := make([]string, 0, len(v))
+	for clientID, count := range v {
+		pairs = append(pairs, clientID+":"+strconv.Itoa(count))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
+
+func ParseVersionVector(value string) (VersionVector, error) {
+	vector := make(VersionVector)
+	for _, pair := range strings.Split(value, ";") {
+		if pair == "" {
+			continue
+		}
+		idCount := strings.SplitN(pair, ":", 2)
+		if len(idCount) != 2 || idCount[0] == "" {
+			return nil, errors.New("invalid version vector " + value)
+		}
+		count, err := strconv.Atoi(idCount[1])
+		if err != nil {
+			return nil, errors.New("invalid version vector " + value)
+		}
+		vector[idCount[0]] = count
+	}
+	return vector, nil
+}
+
+// compareVersionVectors classifies the local version of a file relative to
+// the remote one. ok is false if either has no vector, e.g. because it was
+// uploaded by a client without version vectors.
+func compareVersionVectors(localMeta *FileMetaData, remoteMeta *FileMetaData) (order VectorOrder, ok bool) {
+	if len(localMeta.Vector) == 0 || len(remoteMeta.Vector) == 0 {
+		return VectorEqual, false
+	}
+	return localMeta.Vector.Compare(remoteMeta.Vector), true
+}
+
+// loadClientID returns the ID of the client syncing the base directory,
+// which is created and saved on first use. A new ID is also created if the
+// saved one cannot be read. The error tells that the ID could not be saved,
+// the returned ID is valid in either case.
+func loadClientID(baseDir string) (string, error) {
+	clientID, saved := readClientID(baseDir)
+	if saved {
+		return clientID, nil
+	}
+
+	path := filepath.Join(baseDir, clientStateDir, clientIDFilename)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(path, []byte(clientID+"\n"), 0644)
+	}
+	return clientID, err
+}
+
+// readClientID returns the saved ID of the client syncing the base directory,
+// or a new ID that is not saved if there is none. The vectors of the local
+// files compare the same with either, as no version includes changes of a
+// new ID, so commands that must not change the base directory can plan a
+// sync without saving it.
+func readClientID(baseDir string) (clientID string, saved bool) {
+	content, err := ioutil.ReadFile(filepath.Join(baseDir, clientStateDir, clientIDFilename))
+	if err == nil && strings.TrimSpace(string(content)) != "" {
+		return strings.TrimSpace(string(content)), true
+	}
+	return NewRequestID(), false
+}
+
+// commandClientID returns the ID the commands changing single files on the
+// server count their changes as in version vectors. They change neither the
+// local files nor the index, so counting them as changes of the syncs of the
+// base directory would make the local files look like they include them.
+func commandClientID(clientID string) string {
+	return clientID + "-commands"
+}
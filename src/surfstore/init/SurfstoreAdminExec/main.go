@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"surfstore"
+	"time"
+)
+
+const usage = `Usage: ./run-admin.sh [-users file] <command> [args]
+       ./run-admin.sh -server host:port [-ca file] [-cert file] [-key file] <server command> [args]
+
+Commands:
+  create-token [-admin] <user>  issue a new token, creating the user if needed
+  revoke-token <token-id>       revoke a token
+  set-quota [-physical size] [-logical size] <user>
+                                set the limit of the bytes uploaded by the user and
+                                of the size of its namespace, 0 uses the server default
+  remove-user <user>            remove a user and all of its tokens
+  list-users                    list users and their token ids
+  audit [-log file] [-file name] [-user name] [-namespace name]
+        [-since time] [-until time] [-json]
+                                show the file updates in the audit log of the server,
+                                times are RFC 3339, dates like 2021-03-04, or
+                                durations like 24h before now
+
+Server commands, they use the admin token in SURFSTORE_TOKEN:
+  ls [-namespace name | -all] [-deleted] [-json]
+                                list the files and their versions
+  show [-namespace name] [-json] <file>
+                                show the blocks of a file and their sizes
+  stats [-json]                 show the usage of the namespaces and block store
+  gc [-grace duration] [-dry-run] [-json]
+                                delete the blocks no file refers to and that are
+                                older than the grace period (default 1h)
+  purge [-namespace name] <file>
+                                remove a file and its history, unlike a deletion
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	usersFile := flag.String("users", "users.json", "user accounts file of the server")
+	serverAddr := flag.String("server", "localhost:8080", "address of the server for server commands")
+	caFile := flag.String("ca", "", "connect over TLS, trusting only the CAs in the file")
+	certFile := flag.String("cert", "", "client certificate for servers requiring mutual TLS")
+	keyFile := flag.String("key", "", "private key of the client certificate")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch flag.Arg(0) {
+	case "audit":
+		runAuditCommand(flag.Args()[1:])
+		return
+	case "ls", "show", "stats", "gc", "purge":
+		rpcClient := surfstore.NewSurfstoreRPCClient(*serverAddr, "", 0)
+		rpcClient.Token = os.Getenv("SURFSTORE_TOKEN")
+		if *caFile != "" || *certFile != "" {
+			tlsConfig, err := surfstore.NewClientTLSConfig(*caFile, *certFile, *keyFile)
+			exitOnError(err)
+			rpcClient.TLSConfig = tlsConfig
+		}
+		runServerCommand(rpcClient, flag.Arg(0), flag.Args()[1:])
+		return
+	}
+
+	authStore, err := surfstore.NewAuthStore(*usersFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to load user accounts:", err)
+		os.Exit(1)
+	}
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch command {
+	case "create-token":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		admin := flags.Bool("admin", false, "grant admin rights to the user")
+		_ = flags.Parse(args)
+		if flags.NArg() != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		token, err := authStore.CreateToken(flags.Arg(0), *admin)
+		exitOnError(err)
+		fmt.Println(token)
+	case "revoke-token":
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		exitOnError(authStore.RevokeToken(args[0]))
+	case "set-quota":
+		flags := flag.NewFlagSet(command, flag.ExitOnError)
+		physical := flags.String("physical", "0", "limit of the bytes uploaded by the user, e.g. 512M")
+		logical := flags.String("logical", "0", "limit of the size of all files in the namespace of the user")
+		_ = flags.Parse(args)
+		if flags.NArg() != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		var quota surfstore.Quota
+		quota.PhysicalBytes, err = surfstore.ParseByteSize(*physical)
+		exitOnError(err)
+		quota.LogicalBytes, err = surfstore.ParseByteSize(*logical)
+		exitOnError(err)
+		exitOnError(authStore.SetQuota(flags.Arg(0), quota))
+	case "remove-user":
+		if len(args) != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		exitOnError(authStore.RemoveUser(args[0]))
+	case "list-users":
+		users, err := authStore.ListUsers()
+		exitOnError(err)
+		for _, user := range users {
+			role := "user"
+			if user.Admin {
+				role = "admin"
+			}
+			fmt.Printf("%s\t%s\tquota physical=%d logical=%d\n", user.Name, role, user.Quota.PhysicalBytes, user.Quota.LogicalBytes)
+			for _, token := range user.Tokens {
+				fmt.Printf("\t%s\tcreated %s\n", token.ID, token.CreatedAt.Format("2006-01-02 15:04:05"))
+			}
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func runServerCommand(rpcClient surfstore.RPCClient, command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+	namespace, allNamespaces, includeDeleted := new(string), new(bool), new(bool)
+	grace, dryRun := new(time.Duration), new(bool)
+	switch command {
+	case "ls", "show", "purge":
+		flags.StringVar(namespace, "namespace", "", "namespace of the files, defaults to the namespace of the admin")
+	case "gc":
+		flags.DurationVar(grace, "grace", time.Hour, "keep unreferenced blocks stored within this period")
+		flags.BoolVar(dryRun, "dry-run", false, "only report what would be deleted")
+	}
+	if command == "ls" {
+		flags.BoolVar(allNamespaces, "all", false, "list the files of all namespaces")
+		flags.BoolVar(includeDeleted, "deleted", false, "also list deleted files")
+	}
+	_ = flags.Parse(args)
+
+	needsFile := command == "show" || command == "purge"
+	if needsFile && flags.NArg() != 1 || !needsFile && flags.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var result interface{}
+	var err error
+	switch command {
+	case "ls":
+		var entries []surfstore.AdminFileEntry
+		err = rpcClient.AdminListFiles(surfstore.AdminListArgs{
+			Namespace: *namespace, All: *allNamespaces, IncludeDeleted: *includeDeleted,
+		}, &entries)
+		result = entries
+		if err == nil && !*asJSON {
+			for _, entry := range entries {
+				status := ""
+				if entry.FileMeta.IsTombstone() {
+					status = "\t(deleted)"
+				}
+				fmt.Printf("%s\t%s\tv%d\t%d bytes%s\n", formatNamespace(entry.Namespace), entry.FileMeta.Filename,
+					entry.FileMeta.Version, entry.Size, status)
+			}
+		}
+	case "show":
+		var info surfstore.AdminFileInfo
+		err = rpcClient.AdminShowFile(surfstore.AdminFileArgs{Namespace: *namespace, Filename: flags.Arg(0)}, &info)
+		result = info
+		if err == nil && !*asJSON {
+			fmt.Printf("namespace: %s\nfile:      %s\nversion:   %d\nsize:      %d\n",
+				formatNamespace(info.Namespace), info.FileMeta.Filename, info.FileMeta.Version, info.Size)
+			if info.FileMeta.IsTombstone() {
+				fmt.Println("deleted")
+			}
+			if len(info.FileMeta.Vector) > 0 {
+				fmt.Printf("vector:    %s\n", info.FileMeta.Vector)
+			}
+			if info.FileMeta.RenamedFrom != "" {
+				fmt.Printf("renamed from: %s\n", info.FileMeta.RenamedFrom)
+			}
+			if info.FileMeta.RenamedTo != "" {
+				fmt.Printf("renamed to: %s\n", info.FileMeta.RenamedTo)
+			}
+			if info.FileMeta.IsSymlink() {
+				fmt.Printf("link to:   %s\n", info.FileMeta.LinkTarget)
+			}
+			if info.FileMeta.Mode != 0 {
+				fmt.Printf("mode:      %v\n", os.FileMode(info.FileMeta.Mode))
+			}
+			if info.FileMeta.ModTime != 0 {
+				fmt.Printf("modified:  %s\n", time.Unix(0, info.FileMeta.ModTime).UTC().Format(time.RFC3339))
+			}
+			for i, blockSize := range info.BlockSizes {
+				size := strconv.Itoa(blockSize)
+				if blockSize < 0 {
+					size = "missing"
+				}
+				fmt.Printf("block %d:  %s\t%s\n", i, info.FileMeta.BlockHashList[i], size)
+			}
+		}
+	case "stats":
+		var stats surfstore.AdminStats
+		err = rpcClient.AdminGetStats(&stats)
+		result = stats
+		if err == nil && !*asJSON {
+			fmt.Printf("blocks:              %d (%d bytes)\n", stats.Blocks, stats.BlockBytes)
+			fmt.Printf("unreferenced blocks: %d (%d bytes)\n", stats.UnreferencedBlocks, stats.UnreferencedBytes)
+			fmt.Printf("logical bytes:       %d\n", stats.LogicalBytes)
+			fmt.Printf("dedup ratio:         %.2f\n", stats.DedupRatio)
+			fmt.Printf("metadata entries:    %d\n", stats.MetadataEntries)
+			for _, usage := range stats.Namespaces {
+				fmt.Printf("namespace %s: %d files, %d blocks, %d unique bytes, %d logical bytes\n",
+					formatNamespace(usage.Namespace), usage.Files, usage.Blocks, usage.UniqueBytes, usage.LogicalBytes)
+			}
+		}
+	case "gc":
+		var gcResult surfstore.GCResult
+		err = rpcClient.AdminCollectGarbage(surfstore.GCArgs{GracePeriod: *grace, DryRun: *dryRun}, &gcResult)
+		result = gcResult
+		if err == nil && !*asJSON {
+			verb := "deleted"
+			if *dryRun {
+				verb = "would delete"
+			}
+			fmt.Printf("%s %d blocks (%d bytes)\n", verb, gcResult.Blocks, gcResult.Bytes)
+		}
+	case "purge":
+		succ := false
+		err = rpcClient.AdminPurgeFile(surfstore.AdminFileArgs{Namespace: *namespace, Filename: flags.Arg(0)}, &succ)
+		result = map[string]bool{"Purged": succ}
+		if err == nil && !*asJSON {
+			fmt.Println("purged", flags.Arg(0))
+		}
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		exitOnError(encoder.Encode(result))
+	}
+}
+
+// formatNamespace shows the namespace used without authentication as "-".
+func formatNamespace(namespace string) string {
+	if namespace == "" {
+		return "-"
+	}
+	return namespace
+}
+
+// runAuditCommand reads the audit log directly, it does not need a running
+// server.
+func runAuditCommand(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	logFile := flags.String("log", "audit.log", "audit log file of the server")
+	filename := flags.String("file", "", "only show updates of this file")
+	user := flags.String("user", "", "only show updates by this user")
+	namespace := flags.String("namespace", "", "only show updates in this namespace")
+	since := flags.String("since", "", "only show updates at or after this time")
+	until := flags.String("until", "", "only show updates before this time")
+	asJSON := flags.Bool("json", false, "print the entries as JSON lines")
+	_ = flags.Parse(args)
+	if flags.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	filter := surfstore.AuditFilter{Filename: *filename, User: *user, Namespace: *namespace}
+	var err error
+	filter.Since, err = parseTime(*since)
+	exitOnError(err)
+	filter.Until, err = parseTime(*until)
+	exitOnError(err)
+
+	encoder := json.NewEncoder(os.Stdout)
+	err = surfstore.QueryAuditLog(*logFile, filter, func(entry surfstore.AuditEntry) {
+		if *asJSON {
+			_ = encoder.Encode(entry)
+			return
+		}
+		result := "accepted"
+		if !entry.Accepted {
+			result = "rejected: " + entry.Reason
+		}
+		change := fmt.Sprintf("v%d -> v%d", entry.OldVersion, entry.NewVersion)
+		if entry.Tombstone {
+			change += " (deleted)"
+		}
+		user := entry.User
+		if user == "" {
+			user = "-"
+		}
+		path := entry.Filename
+		if entry.Namespace != "" {
+			path = entry.Namespace + "/" + entry.Filename
+		}
+		fmt.Printf("%s\t%s@%s\t%s\t%s\t%s\n", entry.Time.Local().Format("2006-01-02 15:04:05"),
+			user, entry.Client, path, change, result)
+	})
+	exitOnError(err)
+}
+
+// parseTime accepts RFC 3339 times, dates and durations before now.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", value)
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
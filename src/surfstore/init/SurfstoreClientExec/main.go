@@ -1,25 +1,650 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"surfstore"
 )
 
+const usage = `Usage: ./run-client <command> [options] [arguments]
+
+Commands:
+  init           save the server and block size of the base directory
+  sync           sync the base directory with the server
+  status         list the local and remote changes since the last sync
+  select         choose the folders of the server to sync
+  ls-remote      list the files on the server
+  get            download a file from the server without syncing
+  put            upload a file to the server without syncing
+  history        list the versions the server keeps of a file
+  restore        make a previous version of a file the current one
+  rm             delete a file on the server
+  usage          show the storage used by the namespace
+  share          grant a user access to a folder
+  unshare        revoke the access of a user to a folder
+  collaborators  list the shared folders and their collaborators
+  help           show the help of a command
+
+The server, block size, namespace and TLS files default to the settings saved
+by init in .surfstore/config of the base directory. Run
+"./run-client help <command>" for the options of a command.
+
+The original form syncs once and is still supported:
+  ./run-client [options] host:port baseDir blockSize`
+
+// A command of the client. The arguments are listed in the help after the
+// options.
+type command struct {
+	args    string
+	summary string
+	run     func(flags *flag.FlagSet, clientFlags clientFlags, args []string)
+	// addFlags adds the flags of the command besides the client flags
+	addFlags func(flags *flag.FlagSet)
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"init": {"", "Saves the server, block size, namespace, TLS files and -safe-links given as\n" +
+			"options in .surfstore/config of the base directory.", runInit, nil},
+		"sync": {"", "Syncs the base directory with the server. With -dry-run, only lists the\n" +
+			"files the sync would upload, download or delete.", runSync, addSyncFlags},
+		"status": {"", "Lists the local changes and the changes on the server since the last sync.",
+			runStatus, addScanFlags},
+		"select": {"", "Shows or changes the folders of the server the base directory syncs, as\n" +
+			"comma separated lists of folders. Files below none of the included folders,\n" +
+			"or below an excluded one, are not downloaded and kept on the server. The\n" +
+			"next sync downloads the folders included again and removes the local copies\n" +
+			"of the files excluded, unless they were changed.", runSelect, addSelectFlags},
+		"ls-remote": {"[folder]", "Lists the files on the server, or below a folder.", runListRemote, addListRemoteFlags},
+		"get": {"file", "Writes a file on the server to stdout, or to the file given with -o.",
+			runGet, addGetFlags},
+		"put": {"localFile [file]", "Uploads a local file as new version of the file on the server. The file\n" +
+			"defaults to the path of the local file relative to the base directory,\n" +
+			"or to its name if it is outside of it.", runPut, nil},
+		"history": {"file", "Lists the versions the server keeps of a file.", runHistory, nil},
+		"restore": {"file version", "Uploads a previous version of a file as new version.", runRestore, nil},
+		"rm":      {"file", "Deletes a file on the server.", runRemove, nil},
+		"usage": {"", "Shows the storage used by the namespace and the remaining quota.",
+			runUsage, nil},
+		"share": {"folder user r|rw", "Grants a user read-only (r) or read-write (rw) access to a folder.",
+			runSharing, nil},
+		"unshare":       {"folder user", "Revokes the access of a user to a folder.", runSharing, nil},
+		"collaborators": {"[folder]", "Lists the shared folders and their collaborators.", runSharing, nil},
+	}
+}
+
+// clientFlags are the flags accepted by every command to select the base
+// directory and the server, and to log.
+type clientFlags struct {
+	dir       *string
+	server    *string
+	blockSize *int
+	namespace *string
+	caFile    *string
+	certFile  *string
+	keyFile   *string
+	safeLinks *bool
+	logLevel  *string
+	logFormat *string
+}
+
+func addClientFlags(flags *flag.FlagSet) clientFlags {
+	return clientFlags{
+		dir:       flags.String("dir", ".", "base directory"),
+		server:    flags.String("server", "", "host:port of the server"),
+		blockSize: flags.Int("block-size", 0, "size of the blocks files are divided into, in bytes"),
+		namespace: flags.String("namespace", "", "namespace to sync with, defaults to the namespace of the user"),
+		caFile:    flags.String("ca", "", "connect over TLS, trusting only the CAs in the file"),
+		certFile:  flags.String("cert", "", "client certificate for servers requiring mutual TLS"),
+		keyFile:   flags.String("key", "", "private key of the client certificate"),
+		safeLinks: flags.Bool("safe-links", false, "refuse to upload symbolic links pointing outside of the base directory"),
+		logLevel:  flags.String("log-level", "info", "log entries of this level and above: debug, info, warn or error"),
+		logFormat: flags.String("log-format", "logfmt", "log format, logfmt or json"),
+	}
+}
+
+// loadConfig returns the config of the base directory overridden by the
+// flags set on the command line.
+func (f clientFlags) loadConfig() surfstore.ClientConfig {
+	config, err := surfstore.LoadClientConfig(*f.dir)
+	if err != nil {
+		fail(err)
+	}
+	for _, setting := range []struct {
+		value *string
+		flag  string
+	}{
+		{&config.Server, *f.server},
+		{&config.Namespace, *f.namespace},
+		{&config.CAFile, *f.caFile},
+		{&config.CertFile, *f.certFile},
+		{&config.KeyFile, *f.keyFile},
+	} {
+		if setting.flag != "" {
+			*setting.value = setting.flag
+		}
+	}
+	if *f.blockSize != 0 {
+		config.BlockSize = *f.blockSize
+	}
+	if *f.safeLinks {
+		config.SafeLinks = true
+	}
+	if config.BlockSize < 0 {
+		fail("invalid block size " + strconv.Itoa(config.BlockSize) + ", must be positive")
+	}
+	return config
+}
+
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("Usage: ./run-client host:port baseDir blockSize")
+	if len(os.Args) > 1 {
+		name := os.Args[1]
+		if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+			runHelp(os.Args[2:])
+			return
+		}
+		if cmd, ok := commands[name]; ok {
+			flags := flag.NewFlagSet(name, flag.ExitOnError)
+			flags.Usage = func() { printCommandHelp(name, flags) }
+			clientFlags := addClientFlags(flags)
+			if cmd.addFlags != nil {
+				cmd.addFlags(flags)
+			}
+			_ = flags.Parse(os.Args[2:])
+			cmd.run(flags, clientFlags, flags.Args())
+			return
+		}
+	}
+	runLegacy()
+}
+
+// runLegacy runs the original command line, "[options] host:port baseDir
+// blockSize" to sync and "[options] -usage host:port".
+func runLegacy() {
+	flags := flag.CommandLine
+	flags.Usage = func() { fmt.Println(usage) }
+	clientFlags := addClientFlags(flags)
+	showUsage := flags.Bool("usage", false, "show the storage used by the namespace instead of syncing")
+	addScanFlags(flags)
+	flag.Parse()
+	args := flag.Args()
+
+	if *showUsage && len(args) == 1 {
+		*clientFlags.server = args[0]
+		runUsage(flags, clientFlags, nil)
+		return
+	}
+	if len(args) != 3 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+	setPositionalArgs(clientFlags, args)
+	runSync(flags, clientFlags, nil)
+}
+
+// setPositionalArgs applies the arguments "host:port baseDir blockSize" of
+// the original command line.
+func setPositionalArgs(clientFlags clientFlags, args []string) {
+	blockSize, err := strconv.Atoi(args[2])
+	if err != nil || blockSize <= 0 {
+		fail("invalid block size " + args[2] + ", must be a positive number of bytes")
+	}
+	*clientFlags.server = args[0]
+	*clientFlags.dir = args[1]
+	*clientFlags.blockSize = blockSize
+}
+
+func runHelp(args []string) {
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fail("unknown command " + args[0])
+	}
+	flags := flag.NewFlagSet(args[0], flag.ExitOnError)
+	addClientFlags(flags)
+	if cmd.addFlags != nil {
+		cmd.addFlags(flags)
+	}
+	printCommandHelp(args[0], flags)
+}
+
+func printCommandHelp(name string, flags *flag.FlagSet) {
+	cmd := commands[name]
+	fmt.Fprintf(os.Stderr, "Usage: %s\n\n%s\n\nOptions:\n",
+		strings.TrimSpace("./run-client "+name+" [options] "+cmd.args), cmd.summary)
+	flags.SetOutput(os.Stderr)
+	flags.PrintDefaults()
+}
+
+func fail(v interface{}) {
+	fmt.Fprintln(os.Stderr, v)
+	os.Exit(1)
+}
+
+// checkArgs exits with the help of the command unless the number of
+// arguments is in the range.
+func checkArgs(flags *flag.FlagSet, args []string, min int, max int) {
+	if len(args) < min || len(args) > max {
+		flags.Usage()
+		os.Exit(2)
+	}
+}
+
+// newRPCClient connects to the server of the config. Commands working on the
+// files of the base directory need a block size.
+func newRPCClient(clientFlags clientFlags, needsBlockSize bool) surfstore.RPCClient {
+	config := clientFlags.loadConfig()
+	if config.Server == "" {
+		fail("no server given, use -server host:port or save it with init")
+	}
+	if needsBlockSize && config.BlockSize == 0 {
+		fail("no block size given, use -block-size or save it with init")
+	}
+
+	logLevel, err := surfstore.ParseLogLevel(*clientFlags.logLevel)
+	if err != nil {
+		fail(err)
+	}
+	logger, err := surfstore.NewLogger(os.Stderr, logLevel, *clientFlags.logFormat)
+	if err != nil {
+		fail(err)
+	}
+	surfstore.SetLogger(logger)
+
+	rpcClient := surfstore.NewSurfstoreRPCClient(config.Server, *clientFlags.dir, config.BlockSize)
+	rpcClient.Token = os.Getenv("SURFSTORE_TOKEN")
+	rpcClient.Namespace = config.Namespace
+	rpcClient.Selection = config.Selection
+	rpcClient.SafeLinks = config.SafeLinks
+
+	if config.CAFile != "" || config.CertFile != "" {
+		tlsConfig, err := surfstore.NewClientTLSConfig(config.CAFile, config.CertFile, config.KeyFile)
+		if err != nil {
+			fail("Failed to load TLS certificates: " + err.Error())
+		}
+		rpcClient.TLSConfig = tlsConfig
+	}
+	return rpcClient
+}
+
+func runInit(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	checkArgs(flags, args, 0, 0)
+	config := clientFlags.loadConfig()
+	if config.Server == "" || config.BlockSize == 0 {
+		fail("init needs -server and -block-size")
+	}
+	err := os.MkdirAll(*clientFlags.dir, 0755)
+	if err == nil {
+		err = surfstore.SaveClientConfig(*clientFlags.dir, config)
+	}
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("Saved the config of %s: server %s, block size %d\n", *clientFlags.dir, config.Server, config.BlockSize)
+}
+
+func addSyncFlags(flags *flag.FlagSet) {
+	flags.Bool("dry-run", false, "show what the sync would do without doing it")
+	addScanFlags(flags)
+}
+
+func addScanFlags(flags *flag.FlagSet) {
+	flags.Bool("full-rescan", false, "hash every local file instead of only the ones changed since the last scan")
+}
+
+// isFullRescan reports whether -full-rescan was given, for commands scanning
+// the base directory.
+func isFullRescan(flags *flag.FlagSet) bool {
+	fullRescan := flags.Lookup("full-rescan")
+	return fullRescan != nil && fullRescan.Value.String() == "true"
+}
+
+// runSync syncs, or only shows what a sync would do. sync -dry-run does not
+// change the local files, the index or the server.
+func runSync(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	checkArgs(flags, args, 0, 3)
+	if len(args) > 0 {
+		checkArgs(flags, args, 3, 3)
+		setPositionalArgs(clientFlags, args)
+	}
+	rpcClient := newRPCClient(clientFlags, true)
+	rpcClient.FullRescan = isFullRescan(flags)
+
+	dryRun := flags.Lookup("dry-run")
+	if dryRun == nil || dryRun.Value.String() != "true" {
+		surfstore.ClientSync(rpcClient)
+		return
+	}
+	plan, err := surfstore.ComputeSyncPlan(rpcClient)
+	if err != nil {
+		os.Exit(1)
+	}
+	changes := plan.Changes()
+	if len(changes) == 0 {
+		fmt.Println("Everything is up to date")
+	}
+	for _, entry := range changes {
+		fmt.Printf("%-14s %s (local v%d, server v%d)\n", entry.Action, entry.Filename,
+			entry.LocalVersion, entry.RemoteVersion)
+	}
+}
+
+// runStatus does not change the local files, the index or the server.
+func runStatus(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	checkArgs(flags, args, 0, 3)
+	if len(args) > 0 {
+		checkArgs(flags, args, 3, 3)
+		setPositionalArgs(clientFlags, args)
+	}
+	rpcClient := newRPCClient(clientFlags, true)
+	rpcClient.FullRescan = isFullRescan(flags)
+
+	status, err := surfstore.GetSyncStatus(rpcClient)
+	if err != nil {
+		os.Exit(1)
+	}
+	printFileChanges("Local changes", status.Local)
+	printFileChanges("Remote changes", status.Remote)
+}
+
+func printFileChanges(title string, changes []surfstore.FileChange) {
+	if len(changes) == 0 {
+		fmt.Printf("%s: none\n", title)
+		return
+	}
+	fmt.Printf("%s:\n", title)
+	for _, change := range changes {
+		fmt.Printf("  %-9s %s (v%d)\n", change.Change, change.Filename, change.Version)
+	}
+}
+
+func addSelectFlags(flags *flag.FlagSet) {
+	flags.String("include", "", "folders to sync, replacing the included folders")
+	flags.String("exclude", "", "folders not to sync, replacing the excluded folders")
+	flags.Bool("all", false, "sync all folders again")
+}
+
+func runSelect(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	checkArgs(flags, args, 0, 0)
+	config, err := surfstore.LoadClientConfig(*clientFlags.dir)
+	if err != nil {
+		fail(err)
+	}
+
+	changed := false
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "include":
+			config.Selection.Include = surfstore.SplitSelectionPrefixes(f.Value.String())
+		case "exclude":
+			config.Selection.Exclude = surfstore.SplitSelectionPrefixes(f.Value.String())
+		case "all":
+			if f.Value.String() != "true" {
+				return
+			}
+			config.Selection = surfstore.SyncSelection{}
+		default:
+			return
+		}
+		changed = true
+	})
+	if changed {
+		err = surfstore.SaveClientConfig(*clientFlags.dir, config)
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	if len(config.Selection.Include) == 0 && len(config.Selection.Exclude) == 0 {
+		fmt.Println("All folders are synced")
+		return
+	}
+	for _, prefix := range config.Selection.Include {
+		fmt.Printf("include %s/\n", prefix)
+	}
+	for _, prefix := range config.Selection.Exclude {
+		fmt.Printf("exclude %s/\n", prefix)
+	}
+}
+
+func addListRemoteFlags(flags *flag.FlagSet) {
+	flags.Bool("deleted", false, "include deleted files")
+}
+
+func runListRemote(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	checkArgs(flags, args, 0, 1)
+	rpcClient := newRPCClient(clientFlags, false)
+
+	folder := ""
+	if len(args) == 1 {
+		folder = args[0]
+	}
+	includeDeleted := flags.Lookup("deleted").Value.String() == "true"
+	files, err := surfstore.ListRemoteFiles(rpcClient, folder, includeDeleted)
+	if err != nil {
 		os.Exit(1)
 	}
+	for _, fileMeta := range files {
+		fmt.Printf("v%-5d %s%s\n", fileMeta.Version, fileMeta.Filename, formatDeleted(fileMeta))
+	}
+}
+
+func formatDeleted(fileMeta surfstore.FileMetaData) string {
+	if fileMeta.IsTombstone() {
+		return " (deleted)"
+	}
+	return ""
+}
+
+func addGetFlags(flags *flag.FlagSet) {
+	flags.String("o", "", "file to write to instead of stdout")
+	flags.Int("version", 0, "version to download instead of the current one")
+}
+
+func runGet(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	checkArgs(flags, args, 1, 1)
+	rpcClient := newRPCClient(clientFlags, false)
+	version, _ := strconv.Atoi(flags.Lookup("version").Value.String())
+
+	output := flags.Lookup("o").Value.String()
+	if output == "" || output == "-" {
+		err := surfstore.GetFile(rpcClient, args[0], version, os.Stdout)
+		if err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		fail(err)
+	}
+	err = surfstore.GetFile(rpcClient, args[0], version, file)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(output)
+		fail(err)
+	}
+}
+
+func runPut(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	checkArgs(flags, args, 1, 2)
+	rpcClient := newRPCClient(clientFlags, true)
 
-	hostPort := os.Args[1]
-	baseDir := os.Args[2]
-	blockSize, err := strconv.Atoi(os.Args[3])
+	filename := filepath.Base(args[0])
+	if len(args) == 2 {
+		filename = args[1]
+	} else if relPath, ok := getPathInDir(*clientFlags.dir, args[0]); ok {
+		filename = relPath
+	}
+	fileMeta, err := surfstore.PutFile(rpcClient, args[0], filename)
 	if err != nil {
-		fmt.Println("Usage: ./run-client host:port baseDir blockSize")
+		fail(err)
 	}
+	fmt.Printf("Uploaded %s as v%d\n", fileMeta.Filename, fileMeta.Version)
+}
 
-	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, blockSize)
-	surfstore.ClientSync(rpcClient)
+// getPathInDir returns the slash separated path of the file relative to the
+// directory, if the file is inside of it.
+func getPathInDir(dir string, path string) (string, bool) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	relPath, err := filepath.Rel(absDir, absPath)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(relPath), true
+}
+
+func runHistory(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	checkArgs(flags, args, 1, 1)
+	rpcClient := newRPCClient(clientFlags, false)
+
+	var versions []surfstore.FileMetaData
+	err := rpcClient.GetFileHistory(args[0], &versions)
+	if err != nil {
+		os.Exit(1)
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		fileMeta := versions[i]
+		description := fmt.Sprintf("%d blocks", len(fileMeta.BlockHashList))
+		if fileMeta.IsTombstone() {
+			description = "deleted"
+		}
+		if fileMeta.RenamedFrom != "" {
+			description += ", renamed from " + fileMeta.RenamedFrom
+		}
+		if fileMeta.RenamedTo != "" {
+			description += ", renamed to " + fileMeta.RenamedTo
+		}
+		current := ""
+		if i == len(versions)-1 {
+			current = " (current)"
+		}
+		fmt.Printf("v%-5d %s%s\n", fileMeta.Version, description, current)
+	}
+}
+
+func runRestore(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	checkArgs(flags, args, 2, 2)
+	version, err := strconv.Atoi(strings.TrimPrefix(args[1], "v"))
+	if err != nil || version <= 0 {
+		fail("invalid version " + args[1])
+	}
+	rpcClient := newRPCClient(clientFlags, false)
+
+	fileMeta, err := surfstore.RestoreFile(rpcClient, args[0], version)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("Restored v%d of %s as v%d\n", version, fileMeta.Filename, fileMeta.Version)
+}
+
+func runRemove(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	checkArgs(flags, args, 1, 1)
+	rpcClient := newRPCClient(clientFlags, false)
+
+	fileMeta, err := surfstore.RemoveRemoteFile(rpcClient, args[0])
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("Deleted %s as v%d\n", fileMeta.Filename, fileMeta.Version)
+}
+
+func runUsage(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	checkArgs(flags, args, 0, 0)
+	rpcClient := newRPCClient(clientFlags, false)
+
+	succ := true
+	var nsUsage surfstore.Usage
+	err := rpcClient.GetUsage(&succ, &nsUsage)
+	if err != nil {
+		os.Exit(1)
+	}
+	fmt.Printf("namespace:      %q\n", nsUsage.Namespace)
+	fmt.Printf("files:          %d\n", nsUsage.Files)
+	fmt.Printf("blocks:         %d\n", nsUsage.Blocks)
+	fmt.Printf("unique bytes:   %d\n", nsUsage.UniqueBytes)
+	fmt.Printf("logical bytes:  %d%s\n", nsUsage.LogicalBytes, formatQuota(nsUsage.LogicalBytes, nsUsage.LogicalQuota))
+	fmt.Printf("physical bytes: %d%s\n", nsUsage.PhysicalBytes, formatQuota(nsUsage.PhysicalBytes, nsUsage.PhysicalQuota))
+}
+
+func formatQuota(used int64, quota int64) string {
+	if quota <= 0 {
+		return " (no quota)"
+	}
+	remaining := quota - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return fmt.Sprintf(" of %d, %d remaining", quota, remaining)
+}
+
+// isHostPort reports whether the argument is a server address, which the
+// sharing commands used to take as first argument.
+func isHostPort(arg string) bool {
+	_, port, err := net.SplitHostPort(arg)
+	if err != nil {
+		return false
+	}
+	_, err = strconv.Atoi(port)
+	return err == nil
+}
+
+func runSharing(flags *flag.FlagSet, clientFlags clientFlags, args []string) {
+	command := flags.Name()
+	if len(args) > 0 && isHostPort(args[0]) {
+		*clientFlags.server = args[0]
+		args = args[1:]
+	}
+	rpcClient := newRPCClient(clientFlags, false)
+
+	succ := false
+	var err error
+	switch command {
+	case "share":
+		checkArgs(flags, args, 3, 3)
+		access, parseErr := surfstore.ParseAccess(args[2])
+		if parseErr != nil {
+			fail(parseErr)
+		}
+		err = rpcClient.Share(surfstore.ACLEntry{Folder: args[0], User: args[1], Access: access}, &succ)
+	case "unshare":
+		checkArgs(flags, args, 2, 2)
+		err = rpcClient.Unshare(surfstore.ACLEntry{Folder: args[0], User: args[1]}, &succ)
+	default:
+		checkArgs(flags, args, 0, 1)
+		folder := ""
+		if len(args) == 1 {
+			folder = args[0]
+		}
+		var entries []surfstore.ACLEntry
+		err = rpcClient.GetCollaborators(folder, &entries)
+		for _, entry := range entries {
+			fmt.Printf("%s/\t%s\t%s\n", entry.Folder, entry.User, entry.Access)
+		}
+	}
+
+	if err != nil {
+		os.Exit(1)
+	}
 }
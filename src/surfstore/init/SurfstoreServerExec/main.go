@@ -1,11 +1,62 @@
 package main
 
 import (
-	"log"
+	"flag"
+	"fmt"
+	"os"
 	"surfstore"
 )
 
 func main() {
-	serverInstance := surfstore.NewSurfstoreServer()
-	log.Println(surfstore.ServeSurfstoreServer("localhost:8080", serverInstance))
+	configFile := flag.String("config", "", "config file, flags override its settings")
+	applyFlags := surfstore.RegisterConfigFlags(flag.CommandLine)
+	flag.Parse()
+
+	config := surfstore.DefaultConfig()
+	if *configFile != "" {
+		err := surfstore.LoadConfigFile(*configFile, &config)
+		if err != nil {
+			exitWithError("Invalid config file:\n", err)
+		}
+	}
+	err := applyFlags(&config)
+	if err != nil {
+		exitWithError("Invalid flags:\n", err)
+	}
+	err = config.Validate()
+	if err != nil {
+		exitWithError("Invalid config:\n", err)
+	}
+
+	logOutput := os.Stderr
+	if config.LogFile != "" {
+		logOutput, err = os.OpenFile(config.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			exitWithError("Failed to open log file: ", err)
+		}
+		defer logOutput.Close()
+	}
+	logLevel, _ := surfstore.ParseLogLevel(config.LogLevel)
+	logger, err := surfstore.NewLogger(logOutput, logLevel, config.LogFormat)
+	if err != nil {
+		exitWithError("Invalid config:\n", err)
+	}
+	surfstore.SetLogger(logger)
+
+	serverInstance, err := surfstore.NewSurfstoreServerFromConfig(config)
+	if err != nil {
+		exitWithError("Failed to start server: ", err)
+	}
+	err = surfstore.ServeSurfstoreServer(config.ListenAddr, serverInstance)
+	if err != nil {
+		logger.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("server stopped")
+}
+
+func exitWithError(message string, err error) {
+	fmt.Fprint(os.Stderr, message)
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(2)
 }
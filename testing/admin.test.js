@@ -0,0 +1,90 @@
+const { runServer } = require('./libs/server');
+const { runAdmin } = require('./libs/auth');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+// runs a server command of the admin tool and parses its JSON output, the
+// flags must precede the arguments of the command
+function runAdminJSON([command, ...args]) {
+  const { code, stdout, stderr } = runAdmin([command, '-json', ...args]);
+  if (code !== 0) {
+    throw new Error(`admin ${command} failed: ${stderr}`);
+  }
+  return JSON.parse(stdout);
+}
+
+describe('Server administration', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  test('should list the files with their versions and sizes.', async () => {
+    const client = server.getClient({ 't1.txt': 'x'.repeat(blockSize + 10), 't2.txt': 'test2' });
+
+    client.run();
+    client.deleteFiles(['t2.txt']);
+    client.run();
+    const files = runAdminJSON(['ls']);
+    const allFiles = runAdminJSON(['ls', '-deleted']);
+    const shown = runAdminJSON(['show', 't1.txt']);
+
+    expect(files.map(({ FileMeta, Size }) => [FileMeta.Filename, FileMeta.Version, Size])).toEqual([
+      ['t1.txt', 1, blockSize + 10],
+    ]);
+    expect(allFiles.map(({ FileMeta }) => [FileMeta.Filename, FileMeta.Version])).toEqual([
+      ['t1.txt', 1],
+      ['t2.txt', 2],
+    ]);
+    expect(shown.BlockSizes).toEqual([blockSize, 10]);
+  });
+
+  test('should report the statistics of the block store.', async () => {
+    const content = 'a'.repeat(blockSize) + 'b'.repeat(blockSize);
+    const client = server.getClient({ 't1.txt': content, 't2.txt': content });
+
+    client.run();
+    const stats = runAdminJSON(['stats']);
+
+    expect(stats.Blocks).toBe(2);
+    expect(stats.BlockBytes).toBe(2 * blockSize);
+    expect(stats.LogicalBytes).toBe(4 * blockSize);
+    expect(stats.Namespaces[0].Files).toBe(2);
+  });
+
+  test('should purge files and collect their blocks.', async () => {
+    const client1 = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1', 't2.txt': 'test2' });
+
+    client1.run();
+    expect(runAdmin(['purge', 't1.txt']).code).toBe(0);
+    const dryRun = runAdminJSON(['gc', '-grace', '0s', '-dry-run']);
+    const collected = runAdminJSON(['gc', '-grace', '0s']);
+    const again = runAdminJSON(['gc', '-grace', '0s']);
+    const client2 = server.getClient();
+    client2.run();
+
+    expect(dryRun.Blocks).toBe(1);
+    expect(collected.Blocks).toBe(1);
+    expect(again.Blocks).toBe(0);
+    expect(runAdminJSON(['ls', '-deleted']).map(({ FileMeta }) => FileMeta.Filename)).toEqual(['t2.txt']);
+    expect(client2).toHaveExactLocalFiles({ 't2.txt': 'test2' });
+  });
+
+  test('should keep the blocks younger than the grace period.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+
+    client.run();
+    runAdmin(['purge', 't1.txt']);
+    const collected = runAdminJSON(['gc', '-grace', '1h']);
+
+    expect(collected.Blocks).toBe(0);
+    expect(runAdminJSON(['stats']).Blocks).toBe(1);
+  });
+});
@@ -0,0 +1,91 @@
+const path = require('path');
+const tmp = require('tmp');
+const { runServer } = require('./libs/server');
+const { runAdmin } = require('./libs/auth');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+function queryAuditLog(logFile, args = []) {
+  const { code, stdout, stderr } = runAdmin(['audit', '-log', logFile, '-json', ...args]);
+  if (code !== 0) {
+    throw new Error(`audit failed: ${stderr}`);
+  }
+  return stdout
+    .trim()
+    .split('\n')
+    .filter((line) => line)
+    .map((line) => JSON.parse(line));
+}
+
+describe('Audit log', () => {
+  let dir;
+  let logFile;
+  let server;
+
+  beforeEach(async () => {
+    dir = tmp.dirSync({ prefix: 'surfstore-test-audit', unsafeCleanup: true });
+    logFile = path.join(dir.name, 'audit.log');
+    server = runServer(blockSize, { args: ['-audit-log', logFile, '-namespace-quota', '1K'] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+    dir.removeCallback();
+  });
+
+  test('should record the accepted updates in order.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+
+    client.run();
+    client.writeFiles({ 't1.txt': 'Changed test1' });
+    client.run();
+    client.deleteFiles(['t1.txt']);
+    client.run();
+    const entries = queryAuditLog(logFile, ['-file', 't1.txt']);
+
+    expect(entries.map((e) => [e.OldVersion, e.NewVersion, e.Accepted, e.Tombstone])).toEqual([
+      [0, 1, true, false],
+      [1, 2, true, false],
+      [2, 3, true, true],
+    ]);
+  });
+
+  test('should record the rejected updates with the reason.', async () => {
+    const client = server.getClient({ 'large.txt': 'x'.repeat(2048) });
+
+    client.run();
+    const entries = queryAuditLog(logFile, ['-file', 'large.txt']);
+
+    expect(entries.length).toBeGreaterThan(0);
+    for (const entry of entries) {
+      expect(entry.Accepted).toBe(false);
+      expect(entry.Reason).toMatch('quota exceeded');
+    }
+  });
+});
+
+describe('Audit log failures', () => {
+  let server;
+
+  beforeEach(async () => {
+    // every write to /dev/full fails
+    server = runServer(blockSize, { args: ['-audit-log', '/dev/full'] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  test('should reject the updates it cannot audit.', async () => {
+    const client1 = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({});
+  });
+});
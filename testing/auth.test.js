@@ -0,0 +1,62 @@
+const { runServer } = require('./libs/server');
+const { createUsers } = require('./libs/auth');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+describe('Authentication', () => {
+  let users;
+  let server;
+
+  beforeEach(async () => {
+    users = createUsers();
+    server = runServer(blockSize, { args: ['-users', users.usersFile] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+    users.cleanup();
+  });
+
+  const files = { 't1.txt': 'This is test1 test1 test1 test1' };
+
+  test('should sync the files of clients with a valid token.', async () => {
+    const client1 = server.getClient(files, users.getClientOptions('alice'));
+    const client2 = server.getClient({}, users.getClientOptions('alice'));
+
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles(files);
+  });
+
+  test('should reject clients without a token or with an invalid one.', async () => {
+    const token = users.createToken('alice');
+    const [tokenID] = token.split('.');
+    const anonymous = server.getClient(files);
+    const forger = server.getClient(files, { env: { SURFSTORE_TOKEN: `${tokenID}.${'0'.repeat(64)}` } });
+    const alice = server.getClient({}, { env: { SURFSTORE_TOKEN: token } });
+
+    const results = [anonymous.run(), forger.run()];
+    alice.run();
+
+    for (const { stderr } of results) {
+      expect(stderr).toMatch('unauthenticated');
+    }
+    expect(alice).toHaveExactLocalFiles({});
+  });
+
+  test('should reject revoked tokens.', async () => {
+    const token = users.createToken('alice');
+    const client1 = server.getClient(files, { env: { SURFSTORE_TOKEN: token } });
+    const client2 = server.getClient({}, users.getClientOptions('alice'));
+
+    expect(users.runAdmin(['revoke-token', token.split('.')[0]]).code).toBe(0);
+    const { stderr } = client1.run();
+    client2.run();
+
+    expect(stderr).toMatch('unauthenticated');
+    expect(client2).toHaveExactLocalFiles({});
+  });
+});
@@ -0,0 +1,95 @@
+const crypto = require('crypto');
+const { runServer } = require('./libs/server');
+const { createUsers } = require('./libs/auth');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+// returns content of distinct blocks, so every block is charged
+function createContent(size) {
+  return crypto.randomBytes(size / 2).toString('hex');
+}
+
+describe('Batches', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize, { args: ['-user-quota', '16K'] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  test('should upload the other files of a sync if the blocks of one fail.', async () => {
+    const content = createContent(4 * 1024);
+    const client1 = server.getClient({ 't1.txt': content });
+    const client2 = server.getClient();
+
+    client1.run();
+    // the blocks of the copy are on the server already, only the large file
+    // exceeds the quota
+    client1.writeFiles({ 'copy.txt': content, 'large.txt': createContent(20 * 1024) });
+    const { stderr } = client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({ 't1.txt': content, 'copy.txt': content });
+    expect(stderr).toMatch(/msg="quota exceeded, failed to upload file" .*file=large.txt/);
+    expect(stderr).not.toMatch(/failed to upload file" .*file=copy.txt/);
+  });
+
+  test('should upload the other files again after a conflict.', async () => {
+    const client1 = server.getClient({ 't1.txt': 'This is test1', 't2.txt': 'This is test2' });
+    const client2 = server.getClient();
+    const client3 = server.getClient();
+
+    client1.run();
+    client2.run();
+    client1.writeFiles({ 't1.txt': 'Changed by client1' });
+    client1.run();
+    client2.writeFiles({ 't1.txt': 'Changed by client2', 't2.txt': 'Changed by client2', 't3.txt': 'New' });
+    client2.run();
+    client3.run();
+
+    expect(client3).toHaveExactLocalFiles({
+      't1.txt': 'Changed by client1',
+      't2.txt': 'Changed by client2',
+      't3.txt': 'New',
+    });
+  });
+});
+
+describe('Batches of collaborators', () => {
+  let users;
+  let server;
+
+  beforeEach(async () => {
+    users = createUsers();
+    server = runServer(blockSize, { args: ['-users', users.usersFile] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+    users.cleanup();
+  });
+
+  test('should upload the files of a sync the collaborator may write.', async () => {
+    const files = { ro: { 'x.txt': 'This is x' }, rw: { 'y.txt': 'This is y' } };
+    const alice = server.getClient(files, users.getClientOptions('alice'));
+    const bob = server.getClient({}, users.getClientOptions('bob', { args: ['-namespace', 'alice'] }));
+
+    alice.run();
+    alice.runCommand('share', ['ro', 'bob', 'r']);
+    alice.runCommand('share', ['rw', 'bob', 'rw']);
+    bob.run();
+    bob.writeFiles({ ro: { 'x.txt': 'Changed by bob' }, rw: { 'y.txt': 'Changed by bob' } });
+    const { stderr } = bob.run();
+    alice.run();
+
+    expect(alice).toHaveExactLocalFiles({ ro: files.ro, rw: { 'y.txt': 'Changed by bob' } });
+    expect(stderr).toMatch(/msg="failed to upload file" .*file=ro\/x.txt/);
+    expect(stderr).not.toMatch(/failed to upload file" .*file=rw\/y.txt/);
+  });
+});
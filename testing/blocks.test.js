@@ -0,0 +1,98 @@
+const http = require('http');
+const crypto = require('crypto');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const { testing: testingConfig } = require('../package.json');
+
+const blockSize = 4096;
+
+// returns content of distinct blocks
+function createContent(size) {
+  return crypto.randomBytes(size / 2).toString('hex');
+}
+
+function fetchMetrics() {
+  return new Promise((resolve, reject) => {
+    http
+      .get(`http://localhost:${testingConfig['server-port']}/metrics`, (res) => {
+        let body = '';
+        res.on('data', (chunk) => (body += chunk));
+        res.on('end', () => resolve(body));
+      })
+      .on('error', reject);
+  });
+}
+
+// returns the number of blocks downloaded from the server
+async function countGetBlockCalls() {
+  const name = 'surfstore_rpc_calls_total{method="GetBlock",result="ok"}';
+  const line = (await fetchMetrics()).split('\n').find((l) => l.startsWith(`${name} `));
+  return line === undefined ? 0 : parseFloat(line.slice(name.length + 1));
+}
+
+describe('Local block reuse', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  test('should copy the blocks of copied files from the local file.', async () => {
+    const content = createContent(3 * blockSize);
+    const client1 = server.getClient({ 't1.bin': content });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    client1.writeFiles({ docs: { 'copy.bin': content } });
+    client1.run();
+    const before = await countGetBlockCalls();
+    const { stderr } = client2.run();
+    const after = await countGetBlockCalls();
+
+    expect(client2).toHaveExactLocalFiles({ 't1.bin': content, docs: { 'copy.bin': content } });
+    expect(after).toBe(before);
+    expect(stderr).toMatch(/msg="downloaded file" .*file=docs\/copy.bin .*reused_blocks=3/);
+  });
+
+  test('should only download the blocks no local file has.', async () => {
+    const shared = createContent(2 * blockSize);
+    const files = { 't1.bin': shared + createContent(blockSize), 't2.bin': createContent(blockSize) + shared };
+    const client1 = server.getClient({ 't1.bin': files['t1.bin'] });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    client1.writeFiles({ 't2.bin': files['t2.bin'] });
+    client1.run();
+    const before = await countGetBlockCalls();
+    const { stderr } = client2.run();
+    const after = await countGetBlockCalls();
+
+    expect(client2).toHaveExactLocalFiles(files);
+    expect(after - before).toBe(1);
+    expect(stderr).toMatch(/msg="downloaded file" .*file=t2.bin .*reused_blocks=2/);
+  });
+
+  test('should not copy blocks the local files no longer have.', async () => {
+    const content = createContent(2 * blockSize);
+    const client1 = server.getClient({ 't1.bin': content });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    // the index of client2 still has the blocks of t1.bin, the file does not
+    client2.writeFiles({ 't1.bin': 'Changed by client2' });
+    client1.writeFiles({ 't2.bin': content });
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({ 't1.bin': 'Changed by client2', 't2.bin': content });
+  });
+});
@@ -0,0 +1,79 @@
+const fs = require('fs');
+const path = require('path');
+const crypto = require('crypto');
+const tmp = require('tmp');
+const { runServer, runLegacyClient } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+function sha256(content) {
+  return crypto.createHash('sha256').update(content).digest('hex');
+}
+
+describe('Compare-and-swap updates', () => {
+  let dir;
+  let server;
+
+  beforeEach(async () => {
+    dir = tmp.dirSync({ prefix: 'surfstore-test-cas', unsafeCleanup: true });
+    server = runServer(blockSize, { args: ['-backend', 'disk', '-data-dir', path.join(dir.name, 'data')] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+    dir.removeCallback();
+  });
+
+  test('should not replace a version the client has never seen.', async () => {
+    const client1 = server.getClient({ 't1.txt': 'Uploaded by client1' });
+    const client2 = server.getClient({ 't1.txt': 'Never uploaded by client2' });
+    // the index claims a newer version than the server has, e.g. after the
+    // server was restored from a backup
+    fs.writeFileSync(path.join(client2.dir, 'index.txt'), `t1.txt,5,${sha256('Never uploaded by client2')}\n`);
+
+    client1.run();
+    client2.run();
+    client1.run();
+
+    expect(client1).toHaveExactLocalFiles({ 't1.txt': 'Uploaded by client1' });
+    expect(client2).toHaveExactLocalFiles({ 't1.txt': 'Uploaded by client1' });
+    expect(client2).toHaveIndexFileVersions({ 't1.txt': 1 });
+  });
+
+  test('should upload the local changes of an interrupted sync later.', async () => {
+    const client1 = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+    const client2 = server.getClient();
+
+    client1.run();
+    client1.writeFiles({ 't1.txt': 'Changed while the server was down' });
+    await server.stop();
+    client1.run();
+    const index = client1.readIndexFile();
+    await server.restart();
+    await waitForServerStart();
+    client1.run();
+    client2.run();
+
+    expect(index['t1.txt'].version).toBe(1);
+    expect(client2).toHaveExactLocalFiles({ 't1.txt': 'Changed while the server was down' });
+    expect(client2).toHaveIndexFileVersions({ 't1.txt': 2 });
+  });
+
+  test('should accept updates without a base version.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+
+    client.run();
+    client.writeFiles({ 't1.txt': 'Changed by the client' });
+    client.run();
+    // older clients send no base version
+    const { code, stdout } = runLegacyClient('t1.txt', 3);
+    client.run();
+
+    expect(code).toBe(0);
+    expect(stdout).toBe('3\n');
+    expect(client).toHaveExactLocalFiles({});
+    expect(client).toHaveIndexFileVersions({ 't1.txt': 3 });
+  });
+});
@@ -0,0 +1,96 @@
+const fs = require('fs');
+const path = require('path');
+const shell = require('shelljs');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+// parses the output of history into the versions, newest first
+function parseHistory(stdout) {
+  return stdout
+    .trim()
+    .split('\n')
+    .map((line) => parseInt(line.slice(1)));
+}
+
+describe('Client commands', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  test('should sync with the settings saved by init.', async () => {
+    const files = { 't1.txt': 'This is test1 test1 test1 test1' };
+
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+
+    expect(client1.runCommand('init').code).toBe(0);
+    const { code } = shell.exec(`SurfstoreClientExec sync -dir ${client1.dir}`, { silent: true });
+    client2.run();
+
+    expect(code).toBe(0);
+    expect(fs.existsSync(path.join(client1.dir, '.surfstore', 'config'))).toBe(true);
+    expect(client2).toHaveExactLocalFiles(files);
+  });
+
+  test('should put, get and remove single files without syncing.', async () => {
+    const client1 = server.getClient({ 'notes.txt': 'These are the notes' });
+    const client2 = server.getClient();
+
+    expect(client1.runCommand('put', [path.join(client1.dir, 'notes.txt'), 'docs/notes.txt']).code).toBe(0);
+    const listed = client1.runCommand('ls-remote').stdout;
+    const content = client1.runCommand('get', ['docs/notes.txt']).stdout;
+    client2.run();
+    const synced = client2.readFiles();
+    expect(client1.runCommand('rm', ['docs/notes.txt']).code).toBe(0);
+    client2.run();
+
+    expect(listed).toMatch('docs/notes.txt');
+    expect(content).toBe('These are the notes');
+    expect(Object.keys(synced)).toContain('docs/notes.txt');
+    expect(client2).toHaveExactLocalFiles({});
+  });
+
+  test('should list, get and restore previous versions.', async () => {
+    const client1 = server.getClient({ 't1.txt': 'Version 1' });
+    const client2 = server.getClient();
+
+    client1.run();
+    client1.writeFiles({ 't1.txt': 'Version 2' });
+    client1.run();
+    const history = parseHistory(client1.runCommand('history', ['t1.txt']).stdout);
+    const old = client1.runCommand('get', ['-version', '1', 't1.txt']).stdout;
+    expect(client1.runCommand('restore', ['t1.txt', '1']).code).toBe(0);
+    client2.run();
+
+    expect(history).toEqual([2, 1]);
+    expect(old).toBe('Version 1');
+    expect(client2).toHaveExactLocalFiles({ 't1.txt': 'Version 1' });
+    expect(client2).toHaveIndexFileVersions({ 't1.txt': 3 });
+  });
+
+  test('should keep the last 10 previous versions.', async () => {
+    const client = server.getClient({ 't1.txt': 'Version 1' });
+
+    client.run();
+    for (let version = 2; version <= 12; version++) {
+      client.writeFiles({ 't1.txt': `Version ${version}` });
+      client.run();
+    }
+    const history = parseHistory(client.runCommand('history', ['t1.txt']).stdout);
+    const oldest = client.runCommand('get', ['-version', '2', 't1.txt']).stdout;
+    const dropped = client.runCommand('get', ['-version', '1', 't1.txt']);
+
+    expect(history).toEqual([12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2]);
+    expect(oldest).toBe('Version 2');
+    expect(dropped.code).not.toBe(0);
+  });
+});
@@ -0,0 +1,100 @@
+const fs = require('fs');
+const path = require('path');
+const tmp = require('tmp');
+const shell = require('shelljs');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const { testing: testingConfig } = require('../package.json');
+
+const blockSize = 4096;
+
+function runServerCommand(args) {
+  const execCommand = testingConfig['run-server-cmd'].replace('{options}', args.join(' '));
+  return shell.exec(execCommand, { cwd: path.join(__dirname, '../'), silent: true });
+}
+
+describe('Server config', () => {
+  let dir;
+  let server;
+
+  beforeEach(() => {
+    dir = tmp.dirSync({ prefix: 'surfstore-test-config', unsafeCleanup: true });
+  });
+
+  afterEach(async () => {
+    if (server) {
+      await server.cleanup();
+      server = null;
+    }
+    dir.removeCallback();
+  });
+
+  const writeConfig = (content) => {
+    const configFile = path.join(dir.name, 'surfstore.toml');
+    fs.writeFileSync(configFile, content);
+    return configFile;
+  };
+
+  test('should apply the settings of the config file.', async () => {
+    const configFile = writeConfig('listen = "localhost:8080"\n\n[limits]\nmax_block_size = "1K"\n');
+    server = runServer(blockSize, { args: ['-config', configFile] });
+    await waitForServerStart();
+
+    const client1 = server.getClient({ 't1.txt': 'x'.repeat(2048) });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({});
+  });
+
+  test('should let flags override the config file.', async () => {
+    const configFile = writeConfig('[limits]\nmax_block_size = "1K"\n');
+    server = runServer(blockSize, { args: ['-config', configFile, '-max-block-size', '4K'] });
+    await waitForServerStart();
+
+    const files = { 't1.txt': 'x'.repeat(2048) };
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles(files);
+  });
+
+  test('should keep the files of the disk backend across restarts.', async () => {
+    const dataDir = path.join(dir.name, 'data');
+    server = runServer(blockSize, { args: ['-backend', 'disk', '-data-dir', dataDir] });
+    await waitForServerStart();
+
+    const files = { 't1.txt': 'This is test1 test1 test1 test1', 't2.txt': 'This is test2 test2 test2 test2' };
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+
+    client1.run();
+    client1.deleteFiles(['t2.txt']);
+    client1.run();
+    await server.restart({ force: true });
+    await waitForServerStart();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({ 't1.txt': files['t1.txt'] });
+    expect(client2).toHaveIndexFileVersions({ 't1.txt': 1, 't2.txt': 2 });
+  });
+
+  test('should refuse to start with invalid settings.', () => {
+    const results = [
+      runServerCommand(['-backend', 'tape']),
+      runServerCommand(['-backend', 'disk']),
+      runServerCommand(['-max-connections', 'many']),
+      runServerCommand(['-config', writeConfig('[limits]\nuser_quota = "lots"\n')]),
+    ];
+
+    for (const { code } of results) {
+      expect(code).not.toBe(0);
+    }
+  });
+});
@@ -0,0 +1,33 @@
+// legacy-client deletes a file on the server the way clients did before
+// UpdateFileV2, base versions and version vectors: it calls UpdateFile with
+// a tombstone of the given version and prints the latest version it replies.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"surfstore"
+)
+
+func main() {
+	if len(os.Args) != 4 {
+		fmt.Fprintln(os.Stderr, "Usage: legacy-client host:port filename version")
+		os.Exit(2)
+	}
+	version, err := strconv.Atoi(os.Args[3])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid version:", err)
+		os.Exit(2)
+	}
+
+	client := surfstore.NewSurfstoreRPCClient(os.Args[1], "", 0)
+	fileMeta := surfstore.FileMetaData{Filename: os.Args[2], Version: version, BlockHashList: []string{"0"}}
+	var latestVersion int
+	err = client.UpdateFile(&fileMeta, &latestVersion)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(latestVersion)
+}
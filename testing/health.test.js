@@ -0,0 +1,61 @@
+const fs = require('fs');
+const path = require('path');
+const http = require('http');
+const tmp = require('tmp');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const { testing: testingConfig } = require('../package.json');
+
+const blockSize = 4096;
+
+function fetchStatus(endpoint) {
+  return new Promise((resolve, reject) => {
+    http
+      .get(`http://localhost:${testingConfig['server-port']}${endpoint}`, (res) => {
+        let body = '';
+        res.on('data', (chunk) => (body += chunk));
+        res.on('end', () => resolve({ status: res.statusCode, body }));
+      })
+      .on('error', reject);
+  });
+}
+
+describe('Health checks', () => {
+  let dir;
+  let server;
+
+  beforeEach(async () => {
+    dir = tmp.dirSync({ prefix: 'surfstore-test-health', unsafeCleanup: true });
+    server = runServer(blockSize, { args: ['-backend', 'disk', '-data-dir', path.join(dir.name, 'data')] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+    dir.removeCallback();
+  });
+
+  test('should report a running server as alive and ready.', async () => {
+    const health = await fetchStatus('/healthz');
+    const readiness = await fetchStatus('/readyz');
+
+    expect(health).toEqual({ status: 200, body: 'ok\n' });
+    expect(readiness.status).toBe(200);
+    expect(readiness.body).toMatch('storage: ok');
+    expect(readiness.body).toMatch('journal: ok');
+  });
+
+  test('should report the server as not ready while its storage is not writable.', async () => {
+    const blocksDir = path.join(dir.name, 'data', 'blocks');
+    fs.rmSync(blocksDir, { recursive: true, force: true });
+    fs.writeFileSync(blocksDir, 'Not a directory');
+
+    const health = await fetchStatus('/healthz');
+    const readiness = await fetchStatus('/readyz');
+
+    expect(health.status).toBe(200);
+    expect(readiness.status).toBe(503);
+    expect(readiness.body).toMatch(/^storage: (?!ok)/m);
+  });
+});
@@ -0,0 +1,90 @@
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+// the local files of clients exclude dot files, so the expected files leave out
+// the .surfignore files
+describe('Ignore patterns', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  test('should not upload ignored files, unless a negation includes them again.', async () => {
+    const client1 = server.getClient({
+      '.surfignore': '*.swp\n!keep.swp\nnode_modules/\n/build/\n',
+      't1.txt': 'This is test1 test1 test1 test1',
+      't1.txt.swp': 'swap file',
+      'keep.swp': 'kept swap file',
+      node_modules: { 'lib.js': 'module' },
+      build: { 'out.o': 'binary' },
+      docs: { build: { 'notes.txt': 'not the top build directory' }, 'notes.swp': 'swap file' },
+    });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({
+      't1.txt': 'This is test1 test1 test1 test1',
+      'keep.swp': 'kept swap file',
+      docs: { build: { 'notes.txt': 'not the top build directory' } },
+    });
+  });
+
+  test('should not include files of an ignored directory again.', async () => {
+    const client1 = server.getClient({
+      '.surfignore': 'cache/\n!cache/keep.txt\n',
+      't1.txt': 'This is test1 test1 test1 test1',
+      cache: { 'keep.txt': 'ignored with its directory' },
+    });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({ 't1.txt': 'This is test1 test1 test1 test1' });
+  });
+
+  test('should apply the patterns of sub directories below them.', async () => {
+    const client1 = server.getClient({
+      docs: { '.surfignore': '*.log\n', 'run.log': 'log of docs', 't1.txt': 'docs test1' },
+      'run.log': 'log of the base directory',
+    });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({
+      docs: { 't1.txt': 'docs test1' },
+      'run.log': 'log of the base directory',
+    });
+  });
+
+  test('should neither overwrite nor delete ignored local files.', async () => {
+    const client1 = server.getClient({ 't1.log': 'Uploaded by client1', 't2.log': 'Uploaded by client1' });
+    const client2 = server.getClient({
+      '.surfignore': '/.surfignore\n*.log\n',
+      't1.log': 'Local file of client2',
+    });
+
+    client1.run();
+    client2.run();
+    client1.deleteFiles(['t2.log']);
+    client1.run();
+    client2.writeFiles({ 't2.log': 'Recreated by client2' });
+    client2.run();
+    client1.run();
+
+    expect(client2).toHaveExactLocalFiles({ 't1.log': 'Local file of client2', 't2.log': 'Recreated by client2' });
+    expect(client1).toHaveExactLocalFiles({ 't1.log': 'Uploaded by client1' });
+  });
+});
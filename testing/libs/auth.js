@@ -0,0 +1,42 @@
+const path = require('path');
+const tmp = require('tmp');
+const shell = require('shelljs');
+
+const { testing: testingConfig } = require('../../package.json');
+
+function runAdmin(args) {
+  const execCommand = testingConfig['run-admin-cmd'].replace('{options}', args.join(' '));
+  return shell.exec(execCommand, { cwd: path.join(__dirname, '../../'), silent: true });
+}
+module.exports.runAdmin = runAdmin;
+
+// Creates an empty user accounts file for a server started with -users, and
+// issues tokens for its users with the admin command.
+function createUsers() {
+  const dir = tmp.dirSync({ prefix: 'surfstore-test-users', unsafeCleanup: true });
+  const usersFile = path.join(dir.name, 'users.json');
+
+  const createToken = (user, { admin = false } = {}) => {
+    const adminArgs = admin ? ['-admin'] : [];
+    const { code, stdout, stderr } = runAdmin(['-users', usersFile, 'create-token', ...adminArgs, user]);
+    if (code !== 0) {
+      throw new Error(`create-token ${user} failed: ${stderr}`);
+    }
+    return stdout.trim();
+  };
+
+  // returns the client options authenticating as the user
+  const getClientOptions = (user, options) => ({
+    ...options,
+    env: { ...(options ?? {}).env, SURFSTORE_TOKEN: createToken(user) },
+  });
+
+  return {
+    usersFile,
+    createToken,
+    getClientOptions,
+    runAdmin: (args) => runAdmin(['-users', usersFile, ...args]),
+    cleanup: () => dir.removeCallback(),
+  };
+}
+module.exports.createUsers = createUsers;
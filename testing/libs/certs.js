@@ -0,0 +1,53 @@
+const fs = require('fs');
+const path = require('path');
+const tmp = require('tmp');
+const shell = require('shelljs');
+
+function openssl(args, cwd) {
+  const { code, stderr } = shell.exec(`openssl ${args}`, { cwd, silent: true });
+  if (code !== 0) {
+    throw new Error(`openssl ${args.split(' ')[0]} failed: ${stderr}`);
+  }
+}
+
+function createCA(dir, name) {
+  openssl(`req -x509 -newkey rsa:2048 -nodes -days 1 -subj /CN=${name} -keyout ${name}.key -out ${name}.crt`, dir);
+}
+
+function createCert(dir, name, ca, extensions) {
+  fs.writeFileSync(path.join(dir, `${name}.ext`), extensions);
+  openssl(`req -newkey rsa:2048 -nodes -subj /CN=${name} -keyout ${name}.key -out ${name}.csr`, dir);
+  openssl(
+    `x509 -req -in ${name}.csr -CA ${ca}.crt -CAkey ${ca}.key -CAcreateserial ` +
+      `-days 1 -extfile ${name}.ext -out ${name}.crt`,
+    dir
+  );
+}
+
+// Generates a CA with a certificate for the server on localhost and a client
+// certificate, plus an unrelated CA that must not be trusted.
+function createCertificates() {
+  const dir = tmp.dirSync({ prefix: 'surfstore-test-certs', unsafeCleanup: true });
+
+  createCA(dir.name, 'ca');
+  createCA(dir.name, 'other-ca');
+  createCert(
+    dir.name,
+    'localhost',
+    'ca',
+    'subjectAltName=DNS:localhost,IP:127.0.0.1\nextendedKeyUsage=serverAuth\n'
+  );
+  createCert(dir.name, 'client', 'ca', 'extendedKeyUsage=clientAuth\n');
+
+  const file = (name) => path.join(dir.name, name);
+  return {
+    caCert: file('ca.crt'),
+    otherCACert: file('other-ca.crt'),
+    serverCert: file('localhost.crt'),
+    serverKey: file('localhost.key'),
+    clientCert: file('client.crt'),
+    clientKey: file('client.key'),
+    cleanup: () => dir.removeCallback(),
+  };
+}
+module.exports.createCertificates = createCertificates;
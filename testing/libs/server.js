@@ -9,22 +9,40 @@ const { sleep } = require('./utils');
 
 const { testing: testingConfig } = require('../../package.json');
 
-function runServer(blockSize) {
-  const execCommand = testingConfig['run-server-cmd'];
+function runServer(blockSize, serverOptions) {
+  const { args: serverArgs = [], clientArgs = [] } = serverOptions ?? {};
+  const execCommand = testingConfig['run-server-cmd'].replace('{options}', serverArgs.join(' '));
 
-  const serverProcess = shell.exec(execCommand, {
-    cwd: path.join(__dirname, '../../'),
-    silent: true,
-    async: true,
-  });
+  const start = () =>
+    shell.exec(execCommand, {
+      cwd: path.join(__dirname, '../../'),
+      silent: true,
+      async: true,
+    });
+  let serverProcess = start();
+  let exited = new Promise((resolve) => serverProcess.on('exit', resolve));
 
   const clients = [];
   const getClient = (files, options) => {
-    const client = createClient(blockSize, files, options ?? {});
+    const client = createClient(blockSize, files, { args: clientArgs, ...options });
     clients.push(client);
     return client;
   };
 
+  // stops the server with SIGTERM, or SIGKILL if force is set, and resolves
+  // to its exit code once it exited
+  const stop = async ({ force = false } = {}) => {
+    await fkill(`:${testingConfig['server-port']}`, { silent: true, force });
+    return await exited;
+  };
+
+  // restarts the server with the same options, e.g. to check what it persisted
+  const restart = async ({ force = false } = {}) => {
+    await stop({ force });
+    serverProcess = start();
+    exited = new Promise((resolve) => serverProcess.on('exit', resolve));
+  };
+
   const cleanup = async () => {
     await fkill(serverProcess.pid, { silent: true, force: true });
     await fkill(`:${testingConfig['server-port']}`, { silent: true, force: true });
@@ -34,26 +52,61 @@ function runServer(blockSize) {
     }
   };
 
-  return { getClient, cleanup };
+  return { getClient, stop, restart, cleanup };
 }
 module.exports.runServer = runServer;
 
+// deletes a file on the server like clients that only know the UpdateFile
+// call and its reply, see testing/fixture/legacy-client
+function runLegacyClient(filename, version) {
+  const root = path.join(__dirname, '../../');
+  return shell.exec(
+    `go run ./testing/fixture/legacy-client localhost:${testingConfig['server-port']} ${filename} ${version}`,
+    {
+      silent: true,
+      cwd: root,
+      env: { ...process.env, GOPATH: root, GO111MODULE: 'off' },
+      async: false,
+    }
+  );
+}
+module.exports.runLegacyClient = runLegacyClient;
+
 function createClient(blockSize, files, options) {
   const dir = createTempDir(files ?? {});
+  const { silent = true, args = [], env = {} } = options;
+  const execEnv = { ...process.env, ...env };
+
   const execCommand = testingConfig['run-client-cmd']
+    .replace('{options}', args.join(' '))
     .replace('{ip:port}', `localhost:${testingConfig['server-port']}`)
     .replace('{basedir}', dir.name)
     .replace('{blocksize}', blockSize);
 
-  const { silent = true } = options;
-
   const run = () =>
     shell.exec(execCommand, {
       silent,
       cwd: path.join(__dirname, '../../'),
+      env: execEnv,
       async: false,
     });
 
+  // runs a subcommand of the client, e.g. runCommand('get', ['t1.txt'])
+  const runCommand = (command, commandArgs = []) =>
+    shell.exec(
+      testingConfig['run-client-command-cmd']
+        .replace('{command}', command)
+        .replace('{options}', [...args, ...commandArgs].join(' '))
+        .replace('{basedir}', dir.name)
+        .replace('{blocksize}', blockSize),
+      {
+        silent,
+        cwd: path.join(__dirname, '../../'),
+        env: execEnv,
+        async: false,
+      }
+    );
+
   const runAsync = async (delayMiliSeconds = -1) => {
     if (delayMiliSeconds >= 0) {
       await sleep(delayMiliSeconds);
@@ -64,6 +117,7 @@ function createClient(blockSize, files, options) {
         {
           silent,
           cwd: path.join(__dirname, '../../'),
+          env: execEnv,
           async: true,
         },
         () => {
@@ -165,6 +219,7 @@ function createClient(blockSize, files, options) {
   return {
     run,
     runAsync,
+    runCommand,
     writeFiles,
     readFiles,
     deleteFiles,
@@ -0,0 +1,58 @@
+const fs = require('fs');
+const path = require('path');
+const tmp = require('tmp');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+function parseJSONLog(log) {
+  return log
+    .split('\n')
+    .filter((line) => line !== '')
+    .map((line) => JSON.parse(line));
+}
+
+describe('Logging', () => {
+  let dir;
+  let logFile;
+  let server;
+
+  beforeEach(async () => {
+    dir = tmp.dirSync({ prefix: 'surfstore-test-logging', unsafeCleanup: true });
+    logFile = path.join(dir.name, 'server.log');
+    server = runServer(blockSize, { args: ['-log-file', logFile, '-log-level', 'debug'] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+    dir.removeCallback();
+  });
+
+  test('should log the request id of a sync on the client and the server.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' }, { args: ['-log-format', 'json'] });
+
+    const entries = parseJSONLog(client.run().stderr);
+    const requestIDs = new Set(entries.map((entry) => entry.request_id));
+    const [requestID] = requestIDs;
+    const serverLog = fs.readFileSync(logFile, 'utf8');
+
+    expect(requestIDs.size).toBe(1);
+    expect(entries.find((entry) => entry.msg === 'uploaded file').file).toBe('t1.txt');
+    expect(serverLog).toMatch(new RegExp(`msg="file updated" request_id=${requestID} .*file=t1.txt`));
+    expect(serverLog).toMatch(new RegExp(`msg="rpc call" request_id=${requestID} .*rpc=UpdateFiles`));
+  });
+
+  test('should only log the entries of the selected level and above.', async () => {
+    const client1 = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+    const client2 = server.getClient({}, { args: ['-log-level', 'warn'] });
+
+    const { stderr: infoLog } = client1.run();
+    const { stderr: warnLog } = client2.run();
+
+    expect(infoLog).toMatch('level=info msg="sync started"');
+    expect(warnLog).toBe('');
+    expect(client2).toHaveExactLocalFiles({ 't1.txt': 'This is test1 test1 test1 test1' });
+  });
+});
@@ -0,0 +1,94 @@
+const fs = require('fs');
+const path = require('path');
+const http = require('http');
+const tmp = require('tmp');
+const { runServer } = require('./libs/server');
+const { runAdmin } = require('./libs/auth');
+const { waitForServerStart } = require('./libs/utils');
+
+const { testing: testingConfig } = require('../package.json');
+
+const blockSize = 4096;
+
+function fetchMetrics() {
+  return new Promise((resolve, reject) => {
+    http
+      .get(`http://localhost:${testingConfig['server-port']}/metrics`, (res) => {
+        let body = '';
+        res.on('data', (chunk) => (body += chunk));
+        res.on('end', () => resolve(body));
+      })
+      .on('error', reject);
+  });
+}
+
+// returns the value of the metric with the given name and labels
+function getMetric(metrics, name) {
+  const line = metrics.split('\n').find((l) => l.startsWith(`${name} `));
+  return line === undefined ? undefined : parseFloat(line.slice(name.length + 1));
+}
+
+describe('Metrics', () => {
+  let dir;
+  let server;
+
+  beforeEach(async () => {
+    dir = tmp.dirSync({ prefix: 'surfstore-test-metrics', unsafeCleanup: true });
+    server = runServer(blockSize, { args: ['-backend', 'disk', '-data-dir', path.join(dir.name, 'data')] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+    dir.removeCallback();
+  });
+
+  test('should count the RPC calls by method.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+
+    client.run();
+    const metrics = await fetchMetrics();
+
+    expect(getMetric(metrics, 'surfstore_rpc_calls_total{method="PutBlock",result="ok"}')).toBe(1);
+    expect(getMetric(metrics, 'surfstore_metadata_entries')).toBe(1);
+  });
+
+  test('should count every stored block once.', async () => {
+    const content = 'a'.repeat(blockSize) + 'b'.repeat(blockSize);
+    const client = server.getClient({ 't1.txt': content, 't2.txt': content });
+
+    client.run();
+    const metrics = await fetchMetrics();
+
+    expect(getMetric(metrics, 'surfstore_blocks')).toBe(2);
+    expect(getMetric(metrics, 'surfstore_block_bytes')).toBe(2 * blockSize);
+    expect(getMetric(metrics, 'surfstore_logical_bytes')).toBe(4 * blockSize);
+    expect(getMetric(metrics, 'surfstore_dedup_ratio')).toBe(2);
+  });
+
+  test('should not count the blocks deleted by the garbage collection.', async () => {
+    const client = server.getClient({ 't1.txt': 'a'.repeat(blockSize) + 'b'.repeat(blockSize), 't2.txt': 'c' });
+
+    client.run();
+    runAdmin(['purge', 't1.txt']);
+    runAdmin(['gc', '-grace', '0s']);
+    const metrics = await fetchMetrics();
+
+    expect(getMetric(metrics, 'surfstore_blocks')).toBe(1);
+    expect(getMetric(metrics, 'surfstore_block_bytes')).toBe(1);
+  });
+
+  test('should count the blocks stored on disk without metadata.', async () => {
+    const client = server.getClient({ 't1.txt': 'a'.repeat(blockSize) + 'b'.repeat(blockSize) });
+
+    client.run();
+    await server.stop();
+    fs.unlinkSync(path.join(dir.name, 'data', 'journal'));
+    await server.restart();
+    await waitForServerStart();
+    const metrics = await fetchMetrics();
+
+    expect(getMetric(metrics, 'surfstore_blocks')).toBe(2);
+    expect(getMetric(metrics, 'surfstore_metadata_entries')).toBe(0);
+  });
+});
@@ -0,0 +1,68 @@
+const fs = require('fs');
+const path = require('path');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+function statFile(client, filename) {
+  const { mode, mtime } = fs.statSync(path.join(client.dir, filename));
+  return { mode: mode & 0o777, mtime: mtime.getTime() };
+}
+
+describe('File modes and modification times', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  const files = { 'run.sh': '#!/bin/sh\necho test1\n', 't1.txt': 'This is test1 test1 test1 test1' };
+
+  test('should keep the mode and the modification time of files.', async () => {
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+    fs.chmodSync(path.join(client1.dir, 'run.sh'), 0o750);
+    fs.utimesSync(path.join(client1.dir, 't1.txt'), new Date(2021, 2, 4), new Date(2021, 2, 4));
+
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles(files);
+    expect(statFile(client2, 'run.sh').mode).toBe(0o750);
+    expect(statFile(client2, 't1.txt').mtime).toBe(new Date(2021, 2, 4).getTime());
+  });
+
+  test('should upload a new version when only the mode changed.', async () => {
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    fs.chmodSync(path.join(client1.dir, 'run.sh'), 0o755);
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveIndexFileVersions({ 'run.sh': 2, 't1.txt': 1 });
+    expect(statFile(client2, 'run.sh').mode).toBe(0o755);
+  });
+
+  test('should not upload a new version when only the modification time changed.', async () => {
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    fs.utimesSync(path.join(client1.dir, 't1.txt'), new Date(2021, 2, 4), new Date(2021, 2, 4));
+    client1.run();
+    client2.run();
+
+    expect(client1).toHaveIndexFileVersions({ 'run.sh': 1, 't1.txt': 1 });
+    expect(client2).toHaveIndexFileVersions({ 'run.sh': 1, 't1.txt': 1 });
+  });
+});
@@ -0,0 +1,114 @@
+const fs = require('fs');
+const path = require('path');
+const crypto = require('crypto');
+const { runServer } = require('./libs/server');
+const { createUsers } = require('./libs/auth');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+// Makes the next scan of the client take the block hash list of the file from
+// the stat cache instead of reading it, so the client refers to blocks whose
+// content it does not have.
+function forgeStatCache(client, fileName, blockHashList) {
+  const filePath = path.join(client.dir, fileName);
+  const past = new Date(Date.now() - 60 * 1000);
+  fs.utimesSync(filePath, past, past);
+  const stat = fs.statSync(filePath, { bigint: true });
+
+  // the times are in nanoseconds, which do not fit into a JavaScript number
+  const entry =
+    `{"Size":${stat.size},"ModTime":${stat.mtimeNs},"Inode":${stat.ino},"ChangeTime":${stat.ctimeNs},` +
+    `"BlockHashList":${JSON.stringify(blockHashList)}}`;
+  fs.mkdirSync(path.join(client.dir, '.surfstore'), { recursive: true });
+  fs.writeFileSync(
+    path.join(client.dir, '.surfstore', 'statcache'),
+    `{"BlockSize":${blockSize},"Files":{${JSON.stringify(fileName)}:${entry}}}`
+  );
+}
+
+function sha256(content) {
+  return crypto.createHash('sha256').update(content).digest('hex');
+}
+
+describe('Namespaces', () => {
+  let users;
+  let server;
+
+  beforeEach(async () => {
+    users = createUsers();
+    server = runServer(blockSize, { args: ['-users', users.usersFile] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+    users.cleanup();
+  });
+
+  test('should not show the files of other users.', async () => {
+    const files = { 't1.txt': 'This is test1 test1 test1 test1' };
+
+    const alice1 = server.getClient(files, users.getClientOptions('alice'));
+    const alice2 = server.getClient({}, users.getClientOptions('alice'));
+    const bob = server.getClient({ 't2.txt': 'This is test2 test2 test2 test2' }, users.getClientOptions('bob'));
+
+    alice1.run();
+    bob.run();
+    alice2.run();
+
+    expect(alice2).toHaveExactLocalFiles(files);
+    expect(bob).toHaveExactLocalFiles({ 't2.txt': 'This is test2 test2 test2 test2' });
+  });
+
+  test('should sync the same content uploaded by different users.', async () => {
+    const files = { 'same.txt': 'The same content in both namespaces' };
+
+    const alice1 = server.getClient(files, users.getClientOptions('alice'));
+    const alice2 = server.getClient({}, users.getClientOptions('alice'));
+    const bob1 = server.getClient(files, users.getClientOptions('bob'));
+    const bob2 = server.getClient({}, users.getClientOptions('bob'));
+
+    alice1.run();
+    bob1.run();
+    alice2.run();
+    bob2.run();
+
+    expect(alice2).toHaveExactLocalFiles(files);
+    expect(bob2).toHaveExactLocalFiles(files);
+    expect(bob2).toHaveIndexFileHashesMatchLocalFileHashes();
+  });
+
+  test('should not let a client refer to the blocks of another user by their hashes.', async () => {
+    const secret = 'The secret of alice';
+
+    const alice = server.getClient({ 'secret.txt': secret }, users.getClientOptions('alice'));
+    const mallory1 = server.getClient({ 'steal.txt': 'Anything' }, users.getClientOptions('mallory'));
+    const mallory2 = server.getClient({}, users.getClientOptions('mallory'));
+
+    alice.run();
+    forgeStatCache(mallory1, 'steal.txt', [sha256(secret)]);
+    mallory1.run();
+    mallory2.run();
+
+    expect(mallory2).toHaveExactLocalFiles({});
+  });
+
+  test('should let admins select the namespace of another user.', async () => {
+    const files = { 't1.txt': 'This is test1 test1 test1 test1' };
+
+    const alice = server.getClient(files, users.getClientOptions('alice'));
+    const admin = server.getClient(
+      {},
+      { args: ['-namespace', 'alice'], env: { SURFSTORE_TOKEN: users.createToken('root', { admin: true }) } }
+    );
+    const bob = server.getClient({}, users.getClientOptions('bob', { args: ['-namespace', 'alice'] }));
+
+    alice.run();
+    admin.run();
+    bob.run();
+
+    expect(admin).toHaveExactLocalFiles(files);
+    expect(bob).toHaveExactLocalFiles({});
+  });
+});
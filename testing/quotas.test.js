@@ -0,0 +1,104 @@
+const path = require('path');
+const crypto = require('crypto');
+const shell = require('shelljs');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const { testing: testingConfig } = require('../package.json');
+
+const blockSize = 4096;
+
+// returns content of distinct blocks, so every block is charged
+function createContent(size) {
+  return crypto.randomBytes(size / 2).toString('hex');
+}
+
+describe('Quotas', () => {
+  describe('user quota', () => {
+    let server;
+
+    beforeEach(async () => {
+      server = runServer(blockSize, { args: ['-user-quota', '16K'] });
+      await waitForServerStart();
+    });
+
+    afterEach(async () => {
+      await server.cleanup();
+    });
+
+    test('should not upload files exceeding the quota.', async () => {
+      const small = { 'small.txt': createContent(8 * 1024) };
+
+      const client1 = server.getClient(small);
+      const client2 = server.getClient();
+
+      client1.run();
+      client1.writeFiles({ 'large.txt': createContent(12 * 1024) });
+      client1.run();
+      client2.run();
+
+      expect(client2).toHaveExactLocalFiles(small);
+    });
+
+    test('should not charge blocks uploaded before again.', async () => {
+      const content = createContent(12 * 1024);
+
+      const client1 = server.getClient({ 't1.txt': content });
+      const client2 = server.getClient();
+
+      client1.run();
+      client1.writeFiles({ 'copy.txt': content });
+      client1.run();
+      client2.run();
+
+      expect(client2).toHaveExactLocalFiles({ 't1.txt': content, 'copy.txt': content });
+    });
+  });
+
+  describe('namespace quota', () => {
+    let server;
+
+    beforeEach(async () => {
+      server = runServer(blockSize, { args: ['-namespace-quota', '16K'] });
+      await waitForServerStart();
+    });
+
+    afterEach(async () => {
+      await server.cleanup();
+    });
+
+    test('should count every file of the namespace, including copies.', async () => {
+      const content = createContent(12 * 1024);
+      const files = { 't1.txt': content };
+
+      const client1 = server.getClient(files);
+      const client2 = server.getClient();
+
+      client1.run();
+      client1.writeFiles({ 'copy.txt': content });
+      client1.run();
+      client2.run();
+
+      expect(client2).toHaveExactLocalFiles(files);
+    });
+
+    test('should report the usage of the namespace.', async () => {
+      const client = server.getClient({ 't1.txt': createContent(12 * 1024) });
+
+      client.run();
+      const { code, stdout } = client.runCommand('usage');
+
+      expect(code).toBe(0);
+      expect(stdout).toMatch(/12288/);
+      expect(stdout).toMatch(/16384/);
+    });
+  });
+
+  test('should refuse to start with a quota too large for 64 bits.', () => {
+    const execCommand = testingConfig['run-server-cmd'].replace('{options}', '-user-quota 9000000T');
+    const { code, stderr } = shell.exec(execCommand, { cwd: path.join(__dirname, '../'), silent: true });
+
+    expect(code).not.toBe(0);
+    expect(stderr).toMatch('too large');
+  });
+});
@@ -0,0 +1,85 @@
+const fs = require('fs');
+const path = require('path');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+describe('Renames', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  const content = 'This is test1 test1 test1 test1';
+
+  const rename = (client, from, to) => fs.renameSync(path.join(client.dir, from), path.join(client.dir, to));
+
+  test('should record renames in the history of both names.', async () => {
+    const client = server.getClient({ 't1.txt': content });
+
+    client.run();
+    rename(client, 't1.txt', 'renamed.txt');
+    client.run();
+    const { stdout: newHistory } = client.runCommand('history', ['renamed.txt']);
+    const { stdout: oldHistory } = client.runCommand('history', ['t1.txt']);
+
+    expect(newHistory).toMatch(/^v1 .*renamed from t1.txt/m);
+    expect(oldHistory).toMatch(/^v2 .*deleted, renamed to renamed.txt/m);
+  });
+
+  test('should move the unchanged copies of other clients.', async () => {
+    const client1 = server.getClient({ 't1.txt': content });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    const { ino } = fs.statSync(path.join(client2.dir, 't1.txt'));
+    rename(client1, 't1.txt', 'renamed.txt');
+    client1.run();
+    const { stderr } = client2.run();
+
+    expect(client2).toHaveExactLocalFiles({ 'renamed.txt': content });
+    expect(client2).toHaveIndexFileVersions({ 't1.txt': 2, 'renamed.txt': 1 });
+    expect(stderr).toMatch(/msg="renamed file" .*file=renamed.txt from=t1.txt/);
+    expect(fs.statSync(path.join(client2.dir, 'renamed.txt')).ino).toBe(ino);
+  });
+
+  test('should not detect renames of changed files.', async () => {
+    const client1 = server.getClient({ 't1.txt': content });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    rename(client1, 't1.txt', 'renamed.txt');
+    client1.writeFiles({ 'renamed.txt': 'Changed while renaming' });
+    client1.run();
+    const { stderr } = client2.run();
+    const { stdout: history } = client1.runCommand('history', ['renamed.txt']);
+
+    expect(client2).toHaveExactLocalFiles({ 'renamed.txt': 'Changed while renaming' });
+    expect(stderr).not.toMatch('renamed file');
+    expect(history).not.toMatch('renamed from');
+  });
+
+  test('should not detect renames of files with the same content as another one.', async () => {
+    const client1 = server.getClient({ 't1.txt': content, 't2.txt': content });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    rename(client1, 't1.txt', 'renamed1.txt');
+    rename(client1, 't2.txt', 'renamed2.txt');
+    client1.run();
+    const { stderr } = client2.run();
+
+    expect(client2).toHaveExactLocalFiles({ 'renamed1.txt': content, 'renamed2.txt': content });
+    expect(stderr).not.toMatch('renamed file');
+  });
+});
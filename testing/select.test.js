@@ -0,0 +1,89 @@
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+describe('Selective sync', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  const files = {
+    docs: { 't1.txt': 'docs test1', archive: { 'old.txt': 'old docs' } },
+    photos: { 'p1.jpg': 'photo1' },
+    't2.txt': 'This is test2 test2 test2 test2',
+  };
+
+  test('should only download the selected folders.', async () => {
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+
+    client1.run();
+    expect(client2.runCommand('select', ['-include', 'docs,photos', '-exclude', 'docs/archive']).code).toBe(0);
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({ docs: { 't1.txt': 'docs test1' }, photos: { 'p1.jpg': 'photo1' } });
+    expect(client2).toHaveIndexFileVersions({
+      'docs/t1.txt': 1,
+      'docs/archive/old.txt': 1,
+      'photos/p1.jpg': 1,
+      't2.txt': 1,
+    });
+  });
+
+  test('should not delete the excluded files on the server.', async () => {
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+    const client3 = server.getClient();
+
+    client1.run();
+    client2.runCommand('select', ['-include', 'docs']);
+    client2.run();
+    client2.writeFiles({ docs: { 't1.txt': 'Changed by client2' } });
+    client2.run();
+    client3.run();
+
+    expect(client3).toHaveExactLocalFiles({ ...files, docs: { ...files.docs, 't1.txt': 'Changed by client2' } });
+    expect(client3).toHaveIndexFileVersions({
+      'docs/t1.txt': 2,
+      'docs/archive/old.txt': 1,
+      'photos/p1.jpg': 1,
+      't2.txt': 1,
+    });
+  });
+
+  test('should apply a changed selection on the next sync.', async () => {
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.runCommand('select', ['-include', 'docs']);
+    client2.run();
+    client2.runCommand('select', ['-all']);
+    client2.run();
+    const all = client2.readFiles();
+    client2.writeFiles({ photos: { 'p1.jpg': 'Changed by client2' } });
+    client2.runCommand('select', ['-include', 'docs', '-exclude', 'docs/archive']);
+    client2.run();
+    client1.run();
+
+    expect(Object.keys(all).filter((name) => name !== 'index.txt').sort()).toEqual([
+      'docs/archive/old.txt',
+      'docs/t1.txt',
+      'photos/p1.jpg',
+      't2.txt',
+    ]);
+    expect(client2).toHaveExactLocalFiles({
+      docs: { 't1.txt': 'docs test1' },
+      photos: { 'p1.jpg': 'Changed by client2' },
+    });
+    expect(client1).toHaveExactLocalFiles(files);
+  });
+});
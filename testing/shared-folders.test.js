@@ -0,0 +1,157 @@
+const fs = require('fs');
+const path = require('path');
+const { runServer } = require('./libs/server');
+const { createUsers } = require('./libs/auth');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+describe('Shared folders', () => {
+  let users;
+  let server;
+
+  beforeEach(async () => {
+    users = createUsers();
+    server = runServer(blockSize, { args: ['-users', users.usersFile] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+    users.cleanup();
+  });
+
+  const getCollaborator = (user, files) =>
+    server.getClient(files, users.getClientOptions(user, { args: ['-namespace', 'alice'] }));
+
+  test('should sync only the shared folders with collaborators.', async () => {
+    const files = {
+      shared: { 't1.txt': 'This is test1 test1 test1 test1' },
+      private: { 't2.txt': 'This is test2 test2 test2 test2' },
+    };
+
+    const alice = server.getClient(files, users.getClientOptions('alice'));
+    const bob = getCollaborator('bob');
+
+    alice.run();
+    expect(alice.runCommand('share', ['shared', 'bob', 'r']).code).toBe(0);
+    bob.run();
+
+    expect(bob).toHaveExactLocalFiles({ shared: files.shared });
+  });
+
+  test('should sync changes of read-write collaborators to the owner.', async () => {
+    const files = { shared: { 't1.txt': 'This is test1 test1 test1 test1' } };
+
+    const alice = server.getClient(files, users.getClientOptions('alice'));
+    const bob = getCollaborator('bob');
+
+    alice.run();
+    alice.runCommand('share', ['shared', 'bob', 'rw']);
+    bob.run();
+    bob.writeFiles({ shared: { 't1.txt': 'Changed by bob' } });
+    bob.run();
+    alice.run();
+
+    expect(alice).toHaveExactLocalFiles({ shared: { 't1.txt': 'Changed by bob' } });
+  });
+
+  test('should not accept changes of read-only collaborators.', async () => {
+    const files = { shared: { 't1.txt': 'This is test1 test1 test1 test1' } };
+
+    const alice = server.getClient(files, users.getClientOptions('alice'));
+    const bob = getCollaborator('bob');
+
+    alice.run();
+    alice.runCommand('share', ['shared', 'bob', 'r']);
+    bob.run();
+    bob.writeFiles({ shared: { 't1.txt': 'Changed by bob', 't2.txt': 'Created by bob' } });
+    bob.run();
+    alice.run();
+
+    expect(alice).toHaveExactLocalFiles(files);
+  });
+
+  test('should not let collaborators write outside of the shared folder.', async () => {
+    const files = { shared: { 't1.txt': 'This is test1 test1 test1 test1' } };
+
+    const alice = server.getClient(files, users.getClientOptions('alice'));
+    const bob = getCollaborator('bob', { 'evil.txt': 'Written by bob' });
+
+    alice.run();
+    alice.runCommand('share', ['shared', 'bob', 'rw']);
+    const { code } = bob.runCommand('put', [path.join(bob.dir, 'evil.txt'), 'shared/../private.txt']);
+    alice.run();
+
+    expect(code).not.toBe(0);
+    expect(alice).toHaveExactLocalFiles(files);
+  });
+});
+
+describe('Filenames', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  test('should keep the files put with ".." inside of the base directory.', async () => {
+    const client1 = server.getClient({ 'evil.txt': 'Written by the attacker' });
+    const client2 = server.getClient({});
+    const escapedName = `${path.basename(client2.dir)}-escaped.txt`;
+    const escapedPath = path.join(client2.dir, '..', escapedName);
+
+    client1.runCommand('put', [path.join(client1.dir, 'evil.txt'), `../${escapedName}`]);
+    client2.run();
+
+    const escaped = fs.existsSync(escapedPath);
+    if (escaped) {
+      fs.unlinkSync(escapedPath);
+    }
+    expect(escaped).toBe(false);
+    expect(client2).toHaveExactLocalFiles({ [escapedName]: 'Written by the attacker' });
+  });
+
+  test('should not delete files outside of the base directory.', async () => {
+    const attacker = server.getClient({});
+    const victim = server.getClient({});
+    const outsideName = `${path.basename(victim.dir)}-outside.txt`;
+    const outsidePath = path.join(victim.dir, '..', outsideName);
+    fs.writeFileSync(outsidePath, 'Outside of the base directory');
+
+    // a file in the index that is gone locally is deleted on the server
+    fs.writeFileSync(path.join(attacker.dir, 'index.txt'), `../${outsideName},1,${'0'.repeat(64)}\n`);
+    attacker.run();
+    victim.run();
+
+    const exists = fs.existsSync(outsidePath);
+    if (exists) {
+      fs.unlinkSync(outsidePath);
+    }
+    expect(exists).toBe(true);
+    expect(victim).toHaveExactLocalFiles({});
+  });
+
+  test('should reject files replacing the index or the state of clients.', async () => {
+    const attacker = server.getClient({ 'evil.txt': 'Written by the attacker' });
+    const victim = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+
+    victim.run();
+    const results = ['index.txt', '.surfstore/config', 'a,b.txt'].map((name) =>
+      attacker.runCommand('put', [path.join(attacker.dir, 'evil.txt'), `'${name}'`])
+    );
+    victim.run();
+
+    for (const { code } of results) {
+      expect(code).not.toBe(0);
+    }
+    expect(victim).toHaveExactLocalFiles({ 't1.txt': 'This is test1 test1 test1 test1' });
+    expect(victim).toHaveIndexFileVersions({ 't1.txt': 1 });
+    expect(fs.existsSync(path.join(victim.dir, '.surfstore', 'config'))).toBe(false);
+  });
+});
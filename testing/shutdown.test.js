@@ -0,0 +1,66 @@
+const path = require('path');
+const tmp = require('tmp');
+const { runServer } = require('./libs/server');
+const { waitForServerStart, sleep } = require('./libs/utils');
+
+const blockSize = 4096;
+
+describe('Shutdown', () => {
+  let dir;
+  let server;
+
+  beforeEach(async () => {
+    dir = tmp.dirSync({ prefix: 'surfstore-test-shutdown', unsafeCleanup: true });
+    server = runServer(blockSize, { args: ['-backend', 'disk', '-data-dir', path.join(dir.name, 'data')] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+    dir.removeCallback();
+  });
+
+  test('should exit cleanly on SIGTERM and keep the synced files.', async () => {
+    const files = { 't1.txt': 'This is test1 test1 test1 test1' };
+
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+
+    client1.run();
+    const code = await server.stop();
+    await server.restart();
+    await waitForServerStart();
+    client2.run();
+
+    expect(code).toBe(0);
+    expect(client2).toHaveExactLocalFiles(files);
+  });
+
+  test('should never leave a partially uploaded file when stopped during a sync.', async () => {
+    // distinct blocks, so every one of them is uploaded
+    const blocks = Array.from({ length: 2048 }, (_, i) => `${i}`.padStart(blockSize, '.'));
+    const files = { 'large.bin': blocks.join('') };
+
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+    const client3 = server.getClient();
+
+    const sync = client1.runAsync();
+    await sleep(200);
+    await server.restart();
+    await sync;
+    await waitForServerStart();
+    client2.run();
+
+    const synced = Object.keys(client2.readFiles()).includes('large.bin');
+    if (synced) {
+      expect(client2).toHaveIndexFileHashesMatchLocalFileHashes();
+    }
+
+    client1.run();
+    client3.run();
+
+    expect(client3).toHaveExactLocalFiles(files);
+    expect(client3).toHaveIndexFileHashesMatchLocalFileHashes();
+  });
+});
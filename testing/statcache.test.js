@@ -0,0 +1,78 @@
+const fs = require('fs');
+const path = require('path');
+const crypto = require('crypto');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+function sha256(content) {
+  return crypto.createHash('sha256').update(content).digest('hex');
+}
+
+function getStatCachePath(client) {
+  return path.join(client.dir, '.surfstore', 'statcache');
+}
+
+// sets the modification time of a file to an hour ago, so the scan caches it
+function makeOld(client, filename) {
+  const time = new Date(Date.now() - 3600 * 1000);
+  fs.utimesSync(path.join(client.dir, filename), time, time);
+}
+
+describe('Stat cache', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  test('should only hash the files that changed since the last scan, unless rescanning.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+    makeOld(client, 't1.txt');
+
+    client.run();
+    // a cached hash list differing from the file is only noticed by a rescan;
+    // the cache is edited as text, as parsing loses the nanoseconds of times
+    const statCache = fs.readFileSync(getStatCachePath(client), 'utf8');
+    const hash = sha256('This is test1 test1 test1 test1');
+    expect(statCache).toMatch(hash);
+    fs.writeFileSync(getStatCachePath(client), statCache.replace(hash, sha256('Never written to t1.txt')));
+    const { stdout: cached } = client.runCommand('status');
+    const { stdout: rescanned } = client.runCommand('status', ['-full-rescan']);
+
+    expect(cached).toMatch(/modified\s+t1.txt/);
+    expect(rescanned).not.toMatch('t1.txt');
+  });
+
+  test('should hash files changed without changing their size and modification time.', async () => {
+    const client1 = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+    const client2 = server.getClient();
+    makeOld(client1, 't1.txt');
+
+    client1.run();
+    const { mtime } = fs.statSync(path.join(client1.dir, 't1.txt'));
+    client1.writeFiles({ 't1.txt': 'This is TEST1 TEST1 TEST1 TEST1' });
+    fs.utimesSync(path.join(client1.dir, 't1.txt'), mtime, mtime);
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({ 't1.txt': 'This is TEST1 TEST1 TEST1 TEST1' });
+    expect(client2).toHaveIndexFileVersions({ 't1.txt': 2 });
+  });
+
+  test('should not cache files modified just before the scan.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1', 't2.txt': 'test2' });
+    makeOld(client, 't1.txt');
+
+    client.run();
+    const statCache = JSON.parse(fs.readFileSync(getStatCachePath(client), 'utf8'));
+
+    expect(Object.keys(statCache.Files)).toEqual(['t1.txt']);
+  });
+});
@@ -0,0 +1,76 @@
+const fs = require('fs');
+const path = require('path');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+// returns the lines of the output of a command, without the indentation
+function parseLines(stdout) {
+  return stdout
+    .split('\n')
+    .filter((line) => line.trim() !== '')
+    .map((line) => line.trim().replace(/\s+/g, ' '));
+}
+
+describe('Status and dry-run', () => {
+  let server;
+  let client1;
+  let client2;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+
+    client1 = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1', 't2.txt': 'test2' });
+    client2 = server.getClient();
+    client1.run();
+    client2.run();
+    client1.writeFiles({ 't1.txt': 'Changed by client1', 't3.txt': 'Created by client1' });
+    client1.deleteFiles(['t2.txt']);
+    client1.run();
+    client2.writeFiles({ 't1.txt': 'Changed by client2', 't4.txt': 'Created by client2' });
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  const readState = (client) => ({
+    files: Object.entries(client.readFiles()).map(([name, file]) => [name, file.contents.toString()]),
+    index: fs.readFileSync(path.join(client.dir, 'index.txt'), 'utf8'),
+  });
+
+  test('should list the local and the remote changes since the last sync.', async () => {
+    const { code, stdout } = client2.runCommand('status');
+
+    expect(code).toBe(0);
+    expect(parseLines(stdout)).toEqual([
+      'Local changes:',
+      'modified t1.txt (v2)',
+      'added t4.txt (v1)',
+      'Remote changes:',
+      'modified t1.txt (v2)',
+      'deleted t2.txt (v2)',
+      'added t3.txt (v1)',
+    ]);
+  });
+
+  test('should list the plan of a sync without running it.', async () => {
+    const before = readState(client2);
+
+    const { code, stdout } = client2.runCommand('sync', ['-dry-run']);
+    const after = readState(client2);
+    client1.run();
+
+    expect(code).toBe(0);
+    expect(parseLines(stdout)).toEqual([
+      'conflict t1.txt (local v2, server v2)',
+      'delete local t2.txt (local v1, server v2)',
+      'download t3.txt (local v0, server v1)',
+      'upload t4.txt (local v1, server v0)',
+    ]);
+    expect(after).toEqual(before);
+    expect(client1).toHaveExactLocalFiles({ 't1.txt': 'Changed by client1', 't3.txt': 'Created by client1' });
+  });
+});
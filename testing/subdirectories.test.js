@@ -0,0 +1,63 @@
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+describe('Sub directories', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  test('should sync files in sub directories with their relative path.', async () => {
+    const files = {
+      't1.txt': 'This is test1 test1 test1 test1',
+      docs: {
+        't1.txt': 'This is docs test1 test1 test1',
+        team: { 'notes.txt': 'These are the notes of the team' },
+      },
+    };
+
+    const client1 = server.getClient(files);
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles(files);
+    expect(client2).toHaveIndexFileVersions({ 't1.txt': 1, 'docs/t1.txt': 1, 'docs/team/notes.txt': 1 });
+    expect(client2).toHaveIndexFileHashesMatchLocalFileHashes();
+  });
+
+  test('should sync updates and deletes of files in sub directories.', async () => {
+    const client1 = server.getClient({ docs: { 't1.txt': 'This is test1 test1 test1 test1', 't2.txt': 'test2' } });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    client2.writeFiles({ docs: { 't1.txt': 'Changed by client2' } });
+    client2.deleteFiles(['docs/t2.txt']);
+    client2.run();
+    client1.run();
+
+    expect(client1).toHaveExactLocalFiles({ docs: { 't1.txt': 'Changed by client2' } });
+    expect(client1).toHaveIndexFileVersions({ 'docs/t1.txt': 2, 'docs/t2.txt': 2 });
+  });
+
+  test('should not sync empty directories.', async () => {
+    const client1 = server.getClient({ empty: {}, docs: { 't1.txt': 'This is test1 test1 test1 test1' } });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({ docs: { 't1.txt': 'This is test1 test1 test1 test1' } });
+    expect(Object.keys(client2.readIndexFile())).toEqual(['docs/t1.txt']);
+  });
+});
@@ -0,0 +1,74 @@
+const fs = require('fs');
+const path = require('path');
+const tmp = require('tmp');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+function readLink(client, fileName) {
+  const linkPath = path.join(client.dir, fileName);
+  return fs.lstatSync(linkPath, { throwIfNoEntry: false })?.isSymbolicLink() ? fs.readlinkSync(linkPath) : null;
+}
+
+describe('Symbolic links', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  test('should sync links as links.', async () => {
+    const client1 = server.getClient({ docs: { 't1.txt': 'This is test1 test1 test1 test1' } });
+    const client2 = server.getClient();
+    fs.symlinkSync('docs/t1.txt', path.join(client1.dir, 'link.txt'));
+
+    client1.run();
+    client2.run();
+
+    expect(readLink(client2, 'link.txt')).toBe('docs/t1.txt');
+  });
+
+  test('should never create links pointing outside of the base directory.', async () => {
+    const client1 = server.getClient();
+    const client2 = server.getClient();
+    fs.symlinkSync('/etc/passwd', path.join(client1.dir, 'absolute'));
+    fs.symlinkSync('../outside.txt', path.join(client1.dir, 'escaping'));
+
+    client1.run();
+    client2.run();
+
+    expect(readLink(client2, 'absolute')).toBe(null);
+    expect(readLink(client2, 'escaping')).toBe(null);
+  });
+
+  test('should not upload links pointing outside of the base directory with -safe-links.', async () => {
+    const client1 = server.getClient({}, { args: ['-safe-links'] });
+    const client2 = server.getClient();
+    fs.symlinkSync('/etc/passwd', path.join(client1.dir, 'absolute'));
+
+    client1.run();
+    const { stdout } = client2.runCommand('ls-remote');
+
+    expect(stdout).not.toMatch('absolute');
+  });
+
+  test('should not write files through linked directories.', async () => {
+    const outside = tmp.dirSync({ prefix: 'surfstore-test-outside', unsafeCleanup: true });
+    const attacker = server.getClient({ 'evil.txt': 'Written by the attacker' });
+    const victim = server.getClient();
+    fs.symlinkSync(outside.name, path.join(victim.dir, 'docs'));
+
+    attacker.runCommand('put', [path.join(attacker.dir, 'evil.txt'), 'docs/evil.txt']);
+    victim.run();
+
+    const written = fs.readdirSync(outside.name);
+    outside.removeCallback();
+    expect(written).toEqual([]);
+  });
+});
@@ -0,0 +1,105 @@
+const { runServer } = require('./libs/server');
+const { createCertificates } = require('./libs/certs');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+describe('TLS', () => {
+  let certs;
+
+  beforeAll(() => {
+    certs = createCertificates();
+  });
+
+  afterAll(() => {
+    certs.cleanup();
+  });
+
+  describe('server certificate', () => {
+    let server;
+
+    beforeEach(async () => {
+      server = runServer(blockSize, {
+        args: ['-tls-cert', certs.serverCert, '-tls-key', certs.serverKey],
+      });
+      await waitForServerStart();
+    });
+
+    afterEach(async () => {
+      await server.cleanup();
+    });
+
+    test('should sync files over TLS with a pinned CA.', async () => {
+      const files = {
+        't1.txt': 'This is test1 test1 test1 test1',
+        't2.txt': 'This is test2 test2 test2 test2',
+      };
+
+      const client1 = server.getClient(files, { args: ['-ca', certs.caCert] });
+      const client2 = server.getClient({}, { args: ['-ca', certs.caCert] });
+
+      client1.run();
+      client2.run();
+
+      expect(client1).toHaveExactLocalFiles(files);
+      expect(client2).toHaveExactLocalFiles(files);
+      expect(client2).toHaveIndexFileHashesMatchLocalFileHashes();
+      expect(client2).toHaveIndexFileVersions({ 't1.txt': 1, 't2.txt': 1 });
+    });
+
+    test('should not sync when the server certificate is signed by an untrusted CA.', async () => {
+      const files = { 't1.txt': 'This is test1 test1 test1 test1' };
+
+      const client1 = server.getClient(files, { args: ['-ca', certs.caCert] });
+      const client2 = server.getClient({}, { args: ['-ca', certs.otherCACert] });
+
+      client1.run();
+      client2.run();
+
+      expect(client2).toHaveExactLocalFiles({});
+    });
+  });
+
+  describe('mutual TLS', () => {
+    let server;
+
+    beforeEach(async () => {
+      server = runServer(blockSize, {
+        args: ['-tls-cert', certs.serverCert, '-tls-key', certs.serverKey, '-tls-client-ca', certs.caCert],
+      });
+      await waitForServerStart();
+    });
+
+    afterEach(async () => {
+      await server.cleanup();
+    });
+
+    test('should sync files with a client certificate.', async () => {
+      const files = { 't1.txt': 'This is test1 test1 test1 test1' };
+      const clientArgs = ['-ca', certs.caCert, '-cert', certs.clientCert, '-key', certs.clientKey];
+
+      const client1 = server.getClient(files, { args: clientArgs });
+      const client2 = server.getClient({}, { args: clientArgs });
+
+      client1.run();
+      client2.run();
+
+      expect(client2).toHaveExactLocalFiles(files);
+      expect(client2).toHaveIndexFileVersions({ 't1.txt': 1 });
+    });
+
+    test('should reject clients without a certificate.', async () => {
+      const files = { 't1.txt': 'This is test1 test1 test1 test1' };
+
+      const client1 = server.getClient(files, {
+        args: ['-ca', certs.caCert, '-cert', certs.clientCert, '-key', certs.clientKey],
+      });
+      const client2 = server.getClient({}, { args: ['-ca', certs.caCert] });
+
+      client1.run();
+      client2.run();
+
+      expect(client2).toHaveExactLocalFiles({});
+    });
+  });
+});
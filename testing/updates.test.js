@@ -0,0 +1,94 @@
+const fs = require('fs');
+const path = require('path');
+const http = require('http');
+const crypto = require('crypto');
+const tmp = require('tmp');
+const { runServer, runLegacyClient } = require('./libs/server');
+const { sleep, waitForServerStart } = require('./libs/utils');
+
+const { testing: testingConfig } = require('../package.json');
+
+const blockSize = 4096;
+
+function fetchMetrics() {
+  return new Promise((resolve, reject) => {
+    http
+      .get(`http://localhost:${testingConfig['server-port']}/metrics`, (res) => {
+        let body = '';
+        res.on('data', (chunk) => (body += chunk));
+        res.on('end', () => resolve(body));
+      })
+      .on('error', reject);
+  });
+}
+
+describe('Update results', () => {
+  let dir;
+  let logFile;
+  let server;
+
+  beforeEach(async () => {
+    dir = tmp.dirSync({ prefix: 'surfstore-test-updates', unsafeCleanup: true });
+    logFile = path.join(dir.name, 'server.log');
+    server = runServer(blockSize, { args: ['-log-file', logFile] });
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+    dir.removeCallback();
+  });
+
+  test('should tell why an update was rejected and keep the version of the server.', async () => {
+    const client1 = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    // client1 changes the file while client2 uploads the blocks of its version
+    client2.writeFiles({ 't1.txt': crypto.randomBytes(8 * 1024 * 1024).toString('hex') });
+    const sync = client2.runAsync();
+    await sleep(500);
+    client1.writeFiles({ 't1.txt': 'Changed by client1' });
+    client1.run();
+    await sync;
+    const metrics = await fetchMetrics();
+
+    expect(fs.readFileSync(logFile, 'utf8')).toMatch(
+      /msg="file update rejected" .*file=t1.txt version=2 error="version already exists"/
+    );
+    expect(metrics).toMatch(/^surfstore_update_conflicts_total [1-9]/m);
+    expect(client2).toHaveExactLocalFiles({ 't1.txt': 'Changed by client1' });
+    expect(client2).toHaveIndexFileVersions({ 't1.txt': 2 });
+  });
+
+  test('should report the version the server stored.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+
+    client.run();
+    client.writeFiles({ 't1.txt': 'Changed by put' });
+    const { code, stdout } = client.runCommand('put', [path.join(client.dir, 't1.txt')]);
+
+    expect(code).toBe(0);
+    expect(stdout).toBe('Uploaded t1.txt as v2\n');
+  });
+
+  test('should keep the reply of UpdateFile for older clients.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+
+    client.run();
+    const same = runLegacyClient('t1.txt', 1);
+    const deleted = runLegacyClient('t1.txt', 2);
+    const older = runLegacyClient('t1.txt', 1);
+    client.run();
+
+    // the latest version is left unchanged if the version already exists
+    expect(same.code).toBe(0);
+    expect(same.stdout).toBe('0\n');
+    expect(deleted.code).toBe(0);
+    expect(deleted.stdout).toBe('2\n');
+    expect(older.code).not.toBe(0);
+    expect(older.stderr).toMatch('trying to update an older version');
+    expect(client).toHaveExactLocalFiles({});
+  });
+});
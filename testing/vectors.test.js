@@ -0,0 +1,118 @@
+const fs = require('fs');
+const path = require('path');
+const { runServer } = require('./libs/server');
+const { waitForServerStart } = require('./libs/utils');
+
+const blockSize = 4096;
+
+function readClientID(client) {
+  return fs.readFileSync(path.join(client.dir, '.surfstore', 'client_id'), 'utf8').trim();
+}
+
+function readConflictCopy(client, filename) {
+  const copyPath = path.join(client.dir, '.surfstore', 'conflicts', `${filename}.conflict-${readClientID(client)}`);
+  return fs.existsSync(copyPath) ? fs.readFileSync(copyPath, 'utf8') : null;
+}
+
+describe('Version vectors', () => {
+  let server;
+
+  beforeEach(async () => {
+    server = runServer(blockSize);
+    await waitForServerStart();
+  });
+
+  afterEach(async () => {
+    await server.cleanup();
+  });
+
+  test('should keep the local version of concurrently changed files.', async () => {
+    const client1 = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    client1.writeFiles({ 't1.txt': 'Changed by client1' });
+    client2.writeFiles({ 't1.txt': 'Changed by client2' });
+    client1.run();
+    client2.run();
+
+    expect(client2).toHaveExactLocalFiles({ 't1.txt': 'Changed by client1' });
+    expect(readConflictCopy(client2, 't1.txt')).toBe('Changed by client2');
+  });
+
+  test('should count the changes of all commands as changes of the same client.', async () => {
+    const client = server.getClient({ 'notes.txt': 'These are the notes' });
+
+    expect(client.runCommand('put', [path.join(client.dir, 'notes.txt'), 'docs/notes.txt']).code).toBe(0);
+    const clientID = readClientID(client);
+    expect(client.runCommand('rm', ['docs/notes.txt']).code).toBe(0);
+    client.run();
+
+    expect(clientID).not.toBe('');
+    expect(readClientID(client)).toBe(clientID);
+  });
+
+  test('should keep the local changes made before a restore.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+
+    client.run();
+    client.writeFiles({ 't1.txt': 'Changed by the client' });
+    client.run();
+    client.writeFiles({ 't1.txt': 'Changed again before the restore' });
+    expect(client.runCommand('restore', ['t1.txt', '1']).code).toBe(0);
+    client.run();
+
+    expect(client).toHaveExactLocalFiles({ 't1.txt': 'This is test1 test1 test1 test1' });
+    expect(readConflictCopy(client, 't1.txt')).toBe('Changed again before the restore');
+  });
+
+  test('should plan the same actions in a dry-run as the sync.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+
+    client.run();
+    // the restored index misses the version the client uploaded last
+    const index = fs.readFileSync(path.join(client.dir, 'index.txt'), 'utf8');
+    client.writeFiles({ 't1.txt': 'Changed by the client' });
+    client.run();
+    fs.writeFileSync(path.join(client.dir, 'index.txt'), index);
+    client.writeFiles({ 't1.txt': 'Changed again after restoring the index' });
+    const { stdout: plan } = client.runCommand('sync', ['-dry-run']);
+    const { stderr } = client.run();
+
+    expect(plan).toMatch(/conflict\s+t1.txt/);
+    expect(stderr).toMatch(/msg="conflict, local changes are replaced by the version of the server" .*file=t1.txt/);
+    expect(readConflictCopy(client, 't1.txt')).toBe('Changed again after restoring the index');
+  });
+
+  test('should not save a client ID in a dry-run or a status.', async () => {
+    const client = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+
+    expect(client.runCommand('sync', ['-dry-run']).code).toBe(0);
+    expect(client.runCommand('status').code).toBe(0);
+
+    expect(fs.existsSync(path.join(client.dir, '.surfstore', 'client_id'))).toBe(false);
+  });
+
+  test('should upload offline changes based on the latest remote version.', async () => {
+    const client1 = server.getClient({ 't1.txt': 'This is test1 test1 test1 test1' });
+    const client2 = server.getClient();
+
+    client1.run();
+    client2.run();
+    client1.writeFiles({ 't1.txt': 'Changed by client1' });
+    client1.run();
+    client2.run();
+    client2.writeFiles({ 't1.txt': 'Changed by client2 while offline' });
+    await server.stop();
+    client2.run();
+    await server.restart();
+    await waitForServerStart();
+    client2.run();
+    client1.run();
+
+    expect(client1).toHaveExactLocalFiles({ 't1.txt': 'Changed by client2 while offline' });
+    expect(client1).toHaveIndexFileVersions({ 't1.txt': 3 });
+    expect(fs.existsSync(path.join(client1.dir, '.surfstore', 'conflicts'))).toBe(false);
+  });
+});